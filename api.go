@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
 	"time"
 
 	"github.com/Bnei-Baruch/filer-backend/fileindex"
 	"github.com/Bnei-Baruch/filer-backend/fileutils"
+	"github.com/Bnei-Baruch/filer-backend/notify"
+	"github.com/Bnei-Baruch/filer-backend/signing"
 	"github.com/Bnei-Baruch/filer-backend/transcode"
 	"github.com/labstack/echo/v4"
 	uuid "github.com/satori/go.uuid"
@@ -31,18 +35,55 @@ type (
 	}
 
 	TranscodeReq struct {
-		SHA1   string `json:"sha1" form:"sha1"`
-		Format string `json:"format" form:"format"`
+		SHA1     string `json:"sha1" form:"sha1"`
+		Format   string `json:"format" form:"format"`     // name of a builtin preset
+		Preset   string `json:"preset" form:"preset"`     // name of a preset, overrides Format
+		Priority int    `json:"priority" form:"priority"` // higher priority jobs start first
+
+		// choose the audio stream by the ffprobe index or by the language tag
+		AudioIndex    *int   `json:"audio_index" form:"audio_index"`
+		AudioLanguage string `json:"audio_language" form:"audio_language"`
+	}
+
+	PriorityReq struct {
+		Priority int `json:"priority" form:"priority"`
+	}
+
+	TranscodeResp struct {
+		ID string `json:"id"`
 	}
 
 	UpdateReq struct {
 		Path string `json:"path" form:"path"`
 	}
+
+	ReplayReq struct {
+		ID string `json:"id" form:"id"` // empty to replay all messages
+	}
+
+	ReplayResp struct {
+		ReplayedCount int           `json:"replayed_count"`
+		FailedCount   int           `json:"failed_count"`
+		Replayed      []string      `json:"replayed"`
+		Failed        []ReplayError `json:"failed"` // messages left dead
+	}
+
+	ReplayError struct {
+		ID    string `json:"id"`
+		Error string `json:"error"`
+	}
 )
 
+func (r *TranscodeReq) PresetName() string {
+	if r.Preset != "" {
+		return r.Preset
+	}
+	return r.Format
+}
+
 // POST /api/v1/get
 func postRegFile(c echo.Context) (err error) {
-	c.Response().Header().Set(echo.HeaderAccessControlAllowOrigin, "*")
+	cfg := getconf()
 
 	r := new(RegFileReq)
 	if err = c.Bind(r); err != nil {
@@ -51,12 +92,24 @@ func postRegFile(c echo.Context) (err error) {
 	if r.SHA1 == "" || r.Name == "" {
 		return c.String(http.StatusBadRequest, "Wrong parameters")
 	}
+	if r.ClientIP != "" {
+		if _, err := signing.ParseClient(r.ClientIP); err != nil {
+			return c.String(http.StatusBadRequest, "Wrong clientip")
+		}
+	}
 
 	if _, ok := search(r.SHA1); ok {
-		key := r.SHA1 + "/" + r.Name
-		fileMap.Store(key, time.Now())
 		res := new(RegFileResp)
-		res.URL = srvCtx.Config.BaseURL + key
+		res.URL = cfg.BaseURL + r.SHA1 + "/" + url.PathEscape(r.Name)
+		if cfg.Signing != nil {
+			expires := time.Now().Add(cfg.GetFileExpire)
+			q, err := cfg.Signing.Sign(r.SHA1, r.Name, r.ClientIP, expires)
+			if err != nil {
+				log.Println("Sign:", err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			res.URL += "?" + q.Encode()
+		}
 		return c.JSON(http.StatusOK, res)
 	}
 	return c.NoContent(http.StatusNotFound)
@@ -64,8 +117,6 @@ func postRegFile(c echo.Context) (err error) {
 
 // POST /api/v1/showformat
 func postShowFormat(c echo.Context) (err error) {
-	c.Response().Header().Set(echo.HeaderAccessControlAllowOrigin, "*")
-
 	r := new(ShowFormatReq)
 	if err = c.Bind(r); err != nil {
 		return c.String(http.StatusBadRequest, "Wrong parameters")
@@ -74,8 +125,8 @@ func postShowFormat(c echo.Context) (err error) {
 		return c.String(http.StatusBadRequest, "Wrong parameters")
 	}
 
-	if fl, ok := search(r.SHA1); ok {
-		err, out := transcode.ShowFormat(fl[0].Path)
+	if fr, ok := replica(r.SHA1); ok {
+		err, out := transcode.ShowFormat(fr.Path)
 		if err != nil {
 			return c.String(http.StatusBadRequest, err.Error())
 		}
@@ -89,48 +140,154 @@ func postShowFormat(c echo.Context) (err error) {
 
 // GET /api/v1/transqlen
 func getTransQLen(c echo.Context) (err error) {
-	c.Response().Header().Set(echo.HeaderAccessControlAllowOrigin, "*")
-
 	return c.String(http.StatusOK, fmt.Sprintf("%d\n", srvCtx.Trans.QueueLen()))
 }
 
 // POST /api/v1/transcode
 func postTranscode(c echo.Context) (err error) {
-	c.Response().Header().Set(echo.HeaderAccessControlAllowOrigin, "*")
-
 	r := new(TranscodeReq)
 	if err = c.Bind(r); err != nil {
 		return c.String(http.StatusBadRequest, "Wrong parameters")
 	}
-	if r.SHA1 == "" || r.Format != "mp4" {
+	if r.SHA1 == "" {
 		return c.String(http.StatusBadRequest, "Wrong parameters")
 	}
+	p, ok := srvCtx.Presets[r.PresetName()]
+	if !ok {
+		return c.String(http.StatusBadRequest, "Wrong preset")
+	}
+	if srvCtx.Jobs == nil {
+		return c.String(http.StatusBadRequest, "Transcoder is disabled")
+	}
+	if inHandoff() {
+		return c.String(http.StatusServiceUnavailable, "Transcoder is being upgraded")
+	}
 
-	if fl, ok := search(r.SHA1); ok {
-		err, probe := transcode.Probe(fl[0].Path)
+	if fr, ok := replica(r.SHA1); ok {
+		err, probe := transcode.Probe(fr.Path)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		plan, err := p.Plan(probe, transcode.Select{Index: r.AudioIndex, Language: r.AudioLanguage})
 		if err != nil {
 			return c.String(http.StatusBadRequest, err.Error())
 		}
 
 		var task transcode.TranscodeTask
-		task.Source = fl[0].Path
-		task.Preset = preset(probe)
-		if task.Preset == "" {
-			return c.String(http.StatusBadRequest, "No preset")
+		task.Source = fr.Path
+		task.Preset = plan.Args
+		task.Duration = probe.Format.Duration
+		task.Estimate = plan.Estimate(task.Duration)
+		if !srvCtx.Trans.Admit(task.Estimate) {
+			return c.String(http.StatusInsufficientStorage, "No disk space")
 		}
 
 		uu := uuid.NewV4()
 
-		task.Target = fileutils.AddSlash(srvCtx.Config.TransWork) + uu.String() + ".mp4"
+		task.ID = uu.String()
+		task.Priority = r.Priority
+		task.Target = fileutils.AddSlash(getconf().TransWork) + task.ID + p.Ext
 		task.Ctx = r
+
+		job := &transcode.Job{
+			ID:       task.ID,
+			State:    transcode.JobQueued,
+			SHA1:     r.SHA1,
+			Preset:   r.PresetName(),
+			Duration: task.Duration,
+			Estimate: task.Estimate,
+			Args:     task.Preset,
+			Priority: task.Priority,
+			Source:   task.Source,
+			Target:   task.Target,
+			Created:  time.Now(),
+		}
+		if err = srvCtx.Jobs.Add(job); err != nil {
+			log.Println("Transcode job:", err)
+			return c.String(http.StatusInternalServerError, "Cannot save the job")
+		}
 		if !srvCtx.Trans.Transcode(task) {
+			// the new process resumes the queued job
+			if inHandoff() {
+				return c.JSON(http.StatusServiceUnavailable, TranscodeResp{ID: task.ID})
+			}
+			finishJob(srvCtx.Jobs, task.ID, "", "Queue is full")
 			return c.String(http.StatusBadRequest, "Cannot start transcoding")
 		}
-		return c.NoContent(http.StatusOK)
+		return c.JSON(http.StatusOK, TranscodeResp{ID: task.ID})
+	}
+	return c.NoContent(http.StatusNotFound)
+}
+
+// GET /api/v1/transcode/:id
+func getTranscode(c echo.Context) (err error) {
+	if srvCtx.Jobs != nil {
+		if job, ok := srvCtx.Jobs.Get(c.Param("id")); ok {
+			if p, ok := srvCtx.Trans.Progress(job.ID); ok {
+				job.Progress = &p
+			}
+			return c.JSON(http.StatusOK, job)
+		}
 	}
 	return c.NoContent(http.StatusNotFound)
 }
 
+// GET /api/v1/transcode/status
+func getTransStatus(c echo.Context) (err error) {
+	return c.JSON(http.StatusOK, srvCtx.Trans.Status())
+}
+
+// GET /api/v1/transcode/presets
+func getPresets(c echo.Context) (err error) {
+	ll := make([]*transcode.Preset, 0, len(srvCtx.Presets))
+	for _, p := range srvCtx.Presets {
+		ll = append(ll, p)
+	}
+	sort.Slice(ll, func(i, j int) bool {
+		return ll[i].Name < ll[j].Name
+	})
+	return c.JSON(http.StatusOK, ll)
+}
+
+// DELETE /api/v1/transcode/:id
+func deleteTranscode(c echo.Context) (err error) {
+	if srvCtx.Jobs == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	job, ok := srvCtx.Jobs.Get(c.Param("id"))
+	if !ok {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if job.IsFinished() || !srvCtx.Trans.Cancel(job.ID) {
+		return c.String(http.StatusConflict, "The job is "+job.State)
+	}
+	log.Println("Transcode (cancel):", job.ID, job.Source)
+	return c.NoContent(http.StatusOK)
+}
+
+// PATCH /api/v1/transcode/:id
+func patchTranscode(c echo.Context) (err error) {
+	r := new(PriorityReq)
+	if err = c.Bind(r); err != nil {
+		return c.String(http.StatusBadRequest, "Wrong parameters")
+	}
+	if srvCtx.Jobs == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	job, ok := srvCtx.Jobs.Get(c.Param("id"))
+	if !ok {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if job.State != transcode.JobQueued || !srvCtx.Trans.Reprioritize(job.ID, r.Priority) {
+		return c.String(http.StatusConflict, "The job is "+job.State)
+	}
+	srvCtx.Jobs.Update(job.ID, func(job *transcode.Job) {
+		job.Priority = r.Priority
+	})
+	return c.NoContent(http.StatusOK)
+}
+
 // POST /api/v1/update
 func postUpdate(c echo.Context) (err error) {
 	r := new(UpdateReq)
@@ -149,8 +306,6 @@ func postUpdate(c echo.Context) (err error) {
 
 // GET /api/v1/catalog
 func getCatalog(c echo.Context) (err error) {
-	c.Response().Header().Set(echo.HeaderAccessControlAllowOrigin, "*")
-
 	buf := new(bytes.Buffer)
 	files := getfs().GetAll()
 	for _, fl := range files {
@@ -171,8 +326,6 @@ func getCatalog(c echo.Context) (err error) {
 
 // GET /api/v1/storages
 func getStorages(c echo.Context) (err error) {
-	c.Response().Header().Set(echo.HeaderAccessControlAllowOrigin, "*")
-
 	ll := make([]fileindex.Storage, 0, 100)
 	storages.Range(func(key, value interface{}) bool {
 		st := value.(*fileindex.Storage)
@@ -181,3 +334,58 @@ func getStorages(c echo.Context) (err error) {
 	})
 	return c.JSON(http.StatusOK, ll)
 }
+
+// GET /api/v1/admin/notify
+func getNotifyDead(c echo.Context) (err error) {
+	if srvCtx.Outbox == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	dead, err := srvCtx.Outbox.Dead()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, dead)
+}
+
+// POST /api/v1/admin/notify/replay
+func postNotifyReplay(c echo.Context) (err error) {
+	r := new(ReplayReq)
+	if err = c.Bind(r); err != nil {
+		return c.String(http.StatusBadRequest, "Wrong parameters")
+	}
+	if srvCtx.Outbox == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	if r.ID != "" {
+		if err = srvCtx.Outbox.Replay(r.ID); err != nil {
+			if err == notify.ErrNotFound {
+				return c.NoContent(http.StatusNotFound)
+			}
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		log.Println("Notify replay:", r.ID)
+		return c.JSON(http.StatusOK, ReplayResp{ReplayedCount: 1, Replayed: []string{r.ID}, Failed: []ReplayError{}})
+	}
+
+	dead, err := srvCtx.Outbox.Dead()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	// a failed message stays dead, the rest are replayed anyway
+	res := ReplayResp{Replayed: make([]string, 0, len(dead)), Failed: []ReplayError{}}
+	for _, msg := range dead {
+		if err := srvCtx.Outbox.Replay(msg.ID); err != nil {
+			res.Failed = append(res.Failed, ReplayError{ID: msg.ID, Error: err.Error()})
+			continue
+		}
+		res.Replayed = append(res.Replayed, msg.ID)
+	}
+	res.ReplayedCount, res.FailedCount = len(res.Replayed), len(res.Failed)
+	log.Println("Notify replay:", res.Replayed)
+	if len(res.Failed) > 0 {
+		log.Println("Notify replay failed:", res.Failed)
+	}
+	return c.JSON(http.StatusOK, res)
+}
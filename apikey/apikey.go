@@ -0,0 +1,123 @@
+package apikey
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Scopes of API keys
+const (
+	ScopeDownload  = "download-register"
+	ScopeTranscode = "transcode"
+	ScopeUpdate    = "update"
+	ScopeAdmin     = "admin" // allows everything
+)
+
+const HeaderAPIKey = "X-API-Key"
+
+type (
+	Key struct {
+		Name   string   `toml:"-"`
+		Token  string   `toml:"token"`
+		Scopes []string `toml:"scopes"`
+	}
+
+	// Keys is a set of API keys. The empty set disables authentication.
+	Keys struct {
+		keys []*Key
+		hash [][sha256.Size]byte
+	}
+)
+
+var (
+	ErrNoToken    = errors.New("No API key")
+	ErrWrongToken = errors.New("Wrong API key")
+	ErrScope      = errors.New("API key has no scope")
+	ErrWrongScope = errors.New("Unknown scope")
+	ErrShortToken = errors.New("API key is too short")
+)
+
+const minToken = 16
+
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeDownload, ScopeTranscode, ScopeUpdate, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+func (k *Key) Validate() error {
+	if len(k.Token) < minToken {
+		return ErrShortToken
+	}
+	for _, s := range k.Scopes {
+		if !ValidScope(s) {
+			return ErrWrongScope
+		}
+	}
+	return nil
+}
+
+// Allows reports whether the key has the scope
+func (k *Key) Allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func (ks *Keys) Add(k *Key) error {
+	if err := k.Validate(); err != nil {
+		return err
+	}
+	ks.keys = append(ks.keys, k)
+	ks.hash = append(ks.hash, sha256.Sum256([]byte(k.Token)))
+	return nil
+}
+
+// Enabled reports whether there are keys to authenticate with
+func (ks *Keys) Enabled() bool {
+	return ks != nil && len(ks.keys) > 0
+}
+
+// Lookup the key of token in constant time
+func (ks *Keys) Lookup(token string) (*Key, bool) {
+	h := sha256.Sum256([]byte(token))
+	var found *Key
+	for i := range ks.hash {
+		if subtle.ConstantTimeCompare(h[:], ks.hash[i][:]) == 1 {
+			found = ks.keys[i]
+		}
+	}
+	return found, found != nil
+}
+
+// Token of the request: "Authorization: Bearer <token>" or "X-API-Key: <token>"
+func Token(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.Header.Get(HeaderAPIKey)
+}
+
+// Authorize the request for the scope
+func (ks *Keys) Authorize(r *http.Request, scope string) (*Key, error) {
+	token := Token(r)
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	k, ok := ks.Lookup(token)
+	if !ok {
+		return nil, ErrWrongToken
+	}
+	if !k.Allows(scope) {
+		return k, ErrScope
+	}
+	return k, nil
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/Bnei-Baruch/filer-backend/fileindex"
 	"github.com/Bnei-Baruch/filer-backend/fileutils"
+	"github.com/Bnei-Baruch/filer-backend/notify"
 )
 
 var (
@@ -30,12 +31,9 @@ func InitStorages() {
 	reWIN, _ = regexp.Compile("^[a-z]:$")
 }
 
-// list of index files
-func GetIndexList(path string) IndexList {
+// list of index files. The list is incomplete if there is an error.
+func GetIndexList(path string) (IndexList, error) {
 	ft, err := fileutils.Collect(path)
-	if err != nil {
-		log.Println(err)
-	}
 
 	il := make([]IndexFile, 0, 10)
 	for _, dir := range ft {
@@ -45,7 +43,7 @@ func GetIndexList(path string) IndexList {
 			}
 		}
 	}
-	return il
+	return il, err
 }
 
 // Type: IndexList
@@ -70,8 +68,16 @@ func (idx *IndexMain) GetFS() (fs *fileindex.FastSearch) {
 	return (*fileindex.FastSearch)(atomic.LoadPointer((*unsafe.Pointer)(p)))
 }
 
+// Time of the last Load. It is zero before the first load.
+func (idx *IndexMain) LoadTime() time.Time {
+	idx.Lock()
+	defer idx.Unlock()
+
+	return idx.loaded
+}
+
 func (idx *IndexMain) IsModified() bool {
-	indexes := GetIndexList(idx.Path)
+	indexes, _ := GetIndexList(idx.Path)
 	now := time.Now().Unix()
 
 	idx.Lock()
@@ -96,8 +102,17 @@ func (idx *IndexMain) IsModified() bool {
 }
 
 // Load all indexes recursively. Reload an index if modification time is changed.
+// The current records of an index file are kept if it cannot be loaded or listed.
 func (idx *IndexMain) Load() {
-	indexes := GetIndexList(idx.Path)
+	start := time.Now()
+	indexes, err := GetIndexList(idx.Path)
+	if err != nil {
+		log.Println("Index:", err)
+	} else if len(indexes) == 0 {
+		log.Println("Index: no index files in", idx.Path)
+	}
+	listed := err == nil && len(indexes) > 0
+	failed := !listed
 
 	idx.Lock()
 	curlist := idx.List
@@ -105,29 +120,265 @@ func (idx *IndexMain) Load() {
 
 	list := make(IndexList, 0, 10)
 	fs := fileindex.NewFastSearch()
+	changed := make(map[string]bool) // SHA1s of the reloaded index files
 	for _, idxfile := range indexes {
 		var fl fileindex.FileList
 
 		curidx := curlist.FindPath(idxfile.Path)
 		if curidx == nil || curidx.Mtime != idxfile.Mtime {
-			fl = load(idxfile.Path)
+			fl, err = load(idxfile.Path)
+			if err != nil {
+				log.Println("Index:", idxfile.Path, err)
+				failed = true
+				// reloaded by the next load
+				if curidx != nil {
+					list = append(list, *curidx)
+					fs.AddList(curidx.Files)
+				}
+				continue
+			}
 			log.Printf("Loaded %d records from %s\n", len(fl), idxfile.Path)
+			addSha1s(changed, fl)
+			if curidx != nil {
+				addSha1s(changed, curidx.Files)
+			}
 		} else {
 			fl = curidx.Files
 		}
 		list = append(list, IndexFile{Path: idxfile.Path, Mtime: idxfile.Mtime, Files: fl})
 		fs.AddList(fl)
 	}
+	for _, curidx := range curlist {
+		if indexes.FindPath(curidx.Path) != nil {
+			continue
+		}
+		if !listed {
+			list = append(list, curidx)
+			fs.AddList(curidx.Files)
+		} else {
+			addSha1s(changed, curidx.Files)
+		}
+	}
+
+	// Replay the journal on top of the index files
+	if idx.Journal != nil {
+		addSha1s(changed, idx.Journal.Records())
+		n, err := idx.Journal.Compact(fs)
+		if err != nil {
+			log.Println("Journal:", err)
+		} else if n > 0 {
+			log.Printf("Journal: compacted %d records\n", n)
+		}
+		idx.Journal.Replay(fs)
+	}
 
 	idx.Lock()
+	old := idx.GetFS()
 	idx.List = list
 	idx.SetFS(fs)
+	idx.loaded = time.Now()
 	idx.Unlock()
+	observeIndexLoad(start, list)
+
+	if idx.Events == nil {
+		return
+	}
+
+	p := idx.pending
+	if p == nil {
+		p = &pendingChanges{base: old, sha1s: changed}
+		// Changes made while the filer was down are found by the published state.
+		// Without the state the first load is not a change.
+		if len(curlist) == 0 {
+			p.base = idx.loadPublished()
+			p.sha1s = nil
+		}
+	} else if p.sha1s != nil {
+		for sha1 := range changed {
+			p.sha1s[sha1] = true
+		}
+	}
+
+	// an outage of the index folder is not a removal of its files
+	if failed {
+		idx.pending = p
+		log.Println("Events: the index is incomplete, the changes are published by the next load")
+		return
+	}
+	idx.pending = nil
+	if p.base != nil {
+		idx.publishChanges(p.base, fs, p.sha1s)
+	}
+	if err := idx.savePublished(fs); err != nil {
+		log.Println("Events state:", err)
+	}
+}
+
+// Publish events of replicas (SHA1 and path) added to or removed from the index.
+// Only sha1s are compared, all of them if it is nil.
+func (idx *IndexMain) publishChanges(old, fs *fileindex.FastSearch, sha1s map[string]bool) {
+	pubAdded := idx.Events.Enabled(notify.EventFileAdded)
+	pubRemoved := idx.Events.Enabled(notify.EventFileRemoved)
+	if !pubAdded && !pubRemoved && !idx.Events.Enabled(notify.EventIndexReloaded) {
+		return
+	}
+
+	if sha1s == nil {
+		sha1s = make(map[string]bool)
+		for _, fl := range fs.GetAll() {
+			addSha1s(sha1s, fl)
+		}
+		for _, fl := range old.GetAll() {
+			addSha1s(sha1s, fl)
+		}
+	}
+
+	reload := notify.Event{Type: notify.EventIndexReloaded, Records: fs.Stats().Records}
+	for sha1 := range sha1s {
+		prev, _ := old.Search(sha1)
+		cur, _ := fs.Search(sha1)
+		for _, fr := range cur {
+			if !hasPath(prev, fr.Path) {
+				reload.Added++
+				if pubAdded {
+					idx.Events.Publish(fileEvent(notify.EventFileAdded, fr))
+				}
+			}
+		}
+		for _, fr := range prev {
+			if !hasPath(cur, fr.Path) {
+				reload.Removed++
+				if pubRemoved {
+					idx.Events.Publish(fileEvent(notify.EventFileRemoved, fr))
+				}
+			}
+		}
+	}
+	idx.Events.Publish(reload)
+}
+
+func addSha1s(sha1s map[string]bool, fl fileindex.FileList) {
+	for _, fr := range fl {
+		sha1s[fr.Sha1] = true
+	}
 }
 
+func hasPath(fl fileindex.FileList, path string) bool {
+	for _, fr := range fl {
+		if fr.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Records of the last published state or nil if there is none.
+// The storages of the records are unknown.
+func (idx *IndexMain) loadPublished() *fileindex.FastSearch {
+	if idx.Published == "" {
+		return nil
+	}
+	f, err := os.Open(idx.Published)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Events state:", err)
+		}
+		return nil
+	}
+	defer f.Close()
+
+	fl, err := fileindex.Load(bufio.NewReader(f), nil)
+	if err != nil {
+		log.Println("Events state:", idx.Published, err)
+		return nil
+	}
+	fs := fileindex.NewFastSearch()
+	fs.AddList(fl)
+	return fs
+}
+
+// Save the records of fs as the published state
+func (idx *IndexMain) savePublished(fs *fileindex.FastSearch) error {
+	if idx.Published == "" {
+		return nil
+	}
+	tmp := idx.Published + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, fl := range fs.GetAll() {
+		if err = fl.Save(w); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, idx.Published)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Add a record to the current index and to the journal
+func (idx *IndexMain) Update(fr *fileindex.FileRec) {
+	fsdup := idx.GetFS().Duplicate()
+	cur, found := fsdup.SearchPath(fr.Path)
+	fsdup.Update(fr)
+	idx.SetFS(fsdup)
+
+	if !found {
+		idx.Events.Publish(fileEvent(notify.EventFileAdded, fr))
+	} else if cur.Sha1 != fr.Sha1 || cur.Size != fr.Size || cur.Mtime != fr.Mtime {
+		idx.Events.Publish(fileEvent(notify.EventFileChanged, fr))
+	}
+
+	if idx.Journal != nil {
+		if err := idx.Journal.Append(fr); err != nil {
+			log.Println("Journal:", err)
+		}
+	}
+}
+
+func fileEvent(event string, fr *fileindex.FileRec) notify.Event {
+	e := notify.Event{
+		Type:  event,
+		Path:  fr.Path,
+		Sha1:  fr.Sha1,
+		Size:  fr.Size,
+		Mtime: fr.Mtime,
+	}
+	if fr.Device != nil {
+		e.Storage = fr.Device.Id
+	}
+	return e
+}
+
+// Set the index and count its records once for metrics and health checks
 func (idx *IndexMain) SetFS(fs *fileindex.FastSearch) {
+	st := fs.Stats()
 	p := unsafe.Pointer(&idx.fs)
 	atomic.StorePointer((*unsafe.Pointer)(p), unsafe.Pointer(fs))
+	p = unsafe.Pointer(&idx.stats)
+	atomic.StorePointer((*unsafe.Pointer)(p), unsafe.Pointer(&st))
+}
+
+// Stats of the current index
+func (idx *IndexMain) Stats() fileindex.SearchStats {
+	p := unsafe.Pointer(&idx.stats)
+	st := (*fileindex.SearchStats)(atomic.LoadPointer((*unsafe.Pointer)(p)))
+	if st == nil {
+		return fileindex.SearchStats{}
+	}
+	return *st
 }
 
 // filter unnecessary files
@@ -217,11 +468,10 @@ func filter(fr *fileindex.FileRec, storage *fileindex.Storage) bool {
 }
 
 // import an index from path using filter
-func load(path string) fileindex.FileList {
+func load(path string) (fileindex.FileList, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		log.Println(err)
-		return fileindex.FileList{}
+		return nil, err
 	}
 	defer f.Close()
 
@@ -263,11 +513,7 @@ func load(path string) fileindex.FileList {
 		}
 	}
 
-	fl, err := fileindex.Load(bufio.NewReader(f), func(fr *fileindex.FileRec) bool {
+	return fileindex.Load(bufio.NewReader(f), func(fr *fileindex.FileRec) bool {
 		return filter(fr, storage)
 	})
-	if err != nil {
-		log.Println(err)
-	}
-	return fl
 }
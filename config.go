@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Bnei-Baruch/filer-backend/apikey"
+	"github.com/Bnei-Baruch/filer-backend/fileutils"
+	"github.com/Bnei-Baruch/filer-backend/notify"
+	"github.com/Bnei-Baruch/filer-backend/settings"
+	"github.com/Bnei-Baruch/filer-backend/signing"
+	"github.com/Bnei-Baruch/filer-backend/transcode"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/pelletier/go-toml"
+)
+
+// Load the config file, or search for it if the path is empty
+func configLoad(path string) (*toml.Tree, error) {
+	if path != "" {
+		return toml.LoadFile(path)
+	}
+	home := os.Getenv("HOME")
+	config, err := toml.LoadFile(home + "/" + localConf)
+	if os.IsNotExist(err) {
+		config, err = toml.LoadFile(globalConf)
+	}
+	return config, err
+}
+
+// Parse and validate the settings of the config. All problems are returned
+// together as settings.Errors with lines of the config.
+func parseConfig(config *toml.Tree) (*Conf, error) {
+	r := settings.NewReader(config)
+	c := new(Conf)
+
+	r.Required("index.dir")
+	c.Index.Dir = r.String("index.dir", "")
+	c.Index.Journal = r.String("index.journal", "")
+
+	for _, key := range []string{"server.basepath.Archive", "server.basepath.Original", "server.baseurl", "server.listen"} {
+		r.Required(key)
+	}
+	c.Server.BasePathArchive = r.String("server.basepath.Archive", "")
+	c.Server.BasePathOriginal = r.String("server.basepath.Original", "")
+	c.Server.BaseURL = r.String("server.baseurl", "")
+	c.Server.Listen = r.String("server.listen", "")
+	c.Server.GetFileExpire = r.Interval("server.getfileexpire", 7200)
+	c.Server.ShutdownTimeout = r.Seconds("server.shutdowntimeout", 30)
+	c.Server.UpgradeTimeout = r.Interval("server.upgradetimeout", 300)
+	c.Server.StopOnUpdate = r.Bool("server.stoponupdate", false)
+	c.Server.VerifyDownload = r.Bool("server.verifydownload", false)
+	c.Log = r.String("server.log", "")
+
+	current := r.String("server.signing.key", "")
+	if keys := r.StringMap("server.signing.keys"); keys != nil {
+		c.Server.Signing = &signing.Keys{
+			Current: current,
+			Keys:    make(map[string][]byte),
+		}
+		for id, key := range keys {
+			if key == "" || key == "change me" {
+				r.Errorf("server.signing.keys."+id, "set a secret key")
+			}
+			c.Server.Signing.Keys[id] = []byte(key)
+		}
+		if _, ok := c.Server.Signing.Keys[c.Server.Signing.Current]; !ok {
+			r.Errorf("server.signing.key", "key %q is not in server.signing.keys", c.Server.Signing.Current)
+		}
+	}
+	if c.Server.VerifyDownload && c.Server.Signing == nil {
+		r.Errorf("server.verifydownload", "requires server.signing.keys")
+	}
+
+	for _, proxy := range r.Strings("server.trustedproxies", nil) {
+		ipnet, err := signing.ParseClient(proxy)
+		if err != nil {
+			r.Errorf("server.trustedproxies", "%v", err)
+			continue
+		}
+		c.Server.TrustedProxies = append(c.Server.TrustedProxies, ipnet)
+	}
+
+	// in the order of names, the keys are compared on reload
+	c.Server.APIKeys = &apikey.Keys{}
+	keys := r.Tables("auth.keys")
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := keys[name]
+		key := &apikey.Key{Name: name}
+		if !r.Unmarshal("auth.keys."+name, t, key) {
+			continue
+		}
+		if err := c.Server.APIKeys.Add(key); err != nil {
+			r.ErrorAt("auth.keys."+name, t, "%v", err)
+		}
+	}
+
+	c.Server.CORS = make(CORSPolicy)
+	for _, g := range corsGroups {
+		key := "cors." + g.Name
+		cors := middleware.CORSConfig{
+			AllowOrigins:     r.Strings(key+".origins", []string{"*"}),
+			AllowMethods:     r.Strings(key+".methods", []string{}),
+			AllowHeaders:     r.Strings(key+".headers", []string{echo.HeaderAuthorization, echo.HeaderContentType, apikey.HeaderAPIKey}),
+			ExposeHeaders:    r.Strings(key+".expose", []string{echo.HeaderContentDisposition, echo.HeaderContentLength, "Content-Range", "Accept-Ranges", "ETag"}),
+			AllowCredentials: r.Bool(key+".credentials", false),
+			MaxAge:           int(r.Int(key+".maxage", 0, 0, 1<<31-1)),
+		}
+		if cors.AllowCredentials {
+			for _, o := range cors.AllowOrigins {
+				if o == "*" {
+					r.Errorf(key+".credentials", "requires explicit origins")
+					break
+				}
+			}
+		}
+		c.Server.CORS[g.Name] = cors
+	}
+
+	c.Server.RemoteMode = r.String("remote.mode", "proxy")
+	if c.Server.RemoteMode != "proxy" && c.Server.RemoteMode != "redirect" {
+		r.Errorf("remote.mode", "expected \"proxy\" or \"redirect\", got %q", c.Server.RemoteMode)
+	}
+	c.Server.Remote = r.StringMap("remote.locations")
+
+	c.Server.TransNotify = r.String("mdbapp.api", "")
+	c.Server.NotifyStation = r.String("mdbapp.station", "")
+	c.Server.NotifyUser = r.String("mdbapp.user", "")
+	c.Server.NotifyAuth = readAuth(r, "mdbapp")
+	c.Server.NotifyTimeout = r.Interval("mdbapp.timeout", 30)
+	c.Server.NotifyAttempts = int(r.Int("mdbapp.attempts", 10, 1, 1000))
+	c.Server.NotifyBackoff = r.Interval("mdbapp.backoff", 30)
+	c.Server.NotifyOutbox = r.String("mdbapp.outbox", "")
+
+	for _, t := range r.Array("events.webhooks") {
+		var hook notify.Webhook
+		if !r.Unmarshal("events.webhooks", t, &hook) {
+			continue
+		}
+		if err := hook.Validate(); err != nil {
+			r.ErrorAt("events.webhooks", t, "%v", err)
+			continue
+		}
+		c.Events.Hooks = append(c.Events.Hooks, hook)
+	}
+	c.Events.Outbox = r.String("events.outbox", "")
+	c.Events.State = r.String("events.state", "")
+	if c.Events.State == "" && c.Events.Outbox != "" {
+		c.Events.State = filepath.Join(c.Events.Outbox, "index.state")
+	}
+	if r.Has("events.webhooks") && c.Events.Outbox == "" {
+		r.Errorf("events.outbox", "required for events.webhooks")
+	}
+	c.Events.Auth = readAuth(r, "events")
+	c.Events.Timeout = r.Interval("events.timeout", 30)
+	c.Events.Attempts = int(r.Int("events.attempts", 10, 1, 1000))
+	c.Events.Backoff = r.Interval("events.backoff", 30)
+
+	c.Location.Access = r.String("location.access", "local")
+	c.Location.Country = r.String("location.country", "unknown")
+	c.Location.Name = r.String("location.name", "unknown")
+	c.Location.Hostname = fileutils.BaseHostName()
+
+	c.Update.BaseDir = r.String("update.basedir", "/")
+	c.Update.Reload = r.Interval("update.reload", 10)
+
+	c.Transcoder.Concurrency = int(r.Int("transcoder.concurrency", 0, 0, 256))
+	c.Transcoder.KeepJobs = r.Seconds("transcoder.keepjobs", 7*86400)
+	c.Transcoder.StopTimeout = r.Seconds("transcoder.stoptimeout", 60)
+	c.Transcoder.Reserve = r.Int("transcoder.reserve", 10240, 0, 1<<40) << 20
+	c.Transcoder.Presets = make(map[string]*transcode.Preset)
+	for name, p := range transcode.Presets {
+		c.Transcoder.Presets[name] = p
+	}
+	for name, t := range r.Tables("transcoder.presets") {
+		p := new(transcode.Preset)
+		if !r.Unmarshal("transcoder.presets."+name, t, p) {
+			continue
+		}
+		if err := p.Validate(); err != nil {
+			r.ErrorAt("transcoder.presets."+name, t, "%v", err)
+			continue
+		}
+		p.Name = name
+		c.Transcoder.Presets[name] = p
+	}
+	transDest := r.String("server.transdest", "")
+	transWork := r.String("server.transwork", "")
+	tolerance := r.Float("transcoder.tolerance", 2, 0.001, 3600)
+	if c.Transcoder.Concurrency > 0 {
+		r.Required("server.transdest")
+		r.Required("server.transwork")
+		c.Server.TransDest = fileutils.AddSlash(transDest)
+		c.Server.TransWork = fileutils.AddSlash(transWork)
+		c.Server.TransTolerance = tolerance
+	}
+
+	// the files are filtered by filter(), the setting is kept for old configs
+	r.String("index.exclude", "")
+
+	r.Unknown()
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Token and/or secret of notifications in the table
+func readAuth(r *settings.Reader, table string) *notify.Auth {
+	token := r.String(table+".token", "")
+	secret := r.String(table+".secret", "")
+	if token == "" && secret == "" {
+		return nil
+	}
+	return &notify.Auth{Token: token, Secret: []byte(secret)}
+}
+
+// Validate the config file, print all problems. It returns the exit code.
+func checkConfig(path string) int {
+	config, err := configLoad(path)
+	if err == nil {
+		_, err = parseConfig(config)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("OK")
+	return 0
+}
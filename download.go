@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Bnei-Baruch/filer-backend/fileindex"
+	"github.com/Bnei-Baruch/filer-backend/fileutils"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	errProxySha1 = errors.New("SHA1 mismatch")
+
+	// no overall timeout, the files are big
+	proxyClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+
+	proxyRequestHeaders  = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"}
+	proxyResponseHeaders = []string{"Accept-Ranges", "Content-Length", "Content-Range", "Content-Type", "Last-Modified"}
+)
+
+// Content-Disposition header for the name. The "inline" disposition can be
+// chosen by the client, "attachment" is the default.
+func disposition(kind, name string) string {
+	if kind != "inline" {
+		kind = "attachment"
+	}
+	if d := mime.FormatMediaType(kind, map[string]string{"filename": name}); d != "" {
+		return d
+	}
+	return kind
+}
+
+// Send a file registered as sha1/name.
+// The strong ETag is the SHA1 of the content, so http.ServeContent handles
+// Range (including multi-range), If-Range, If-None-Match and HEAD requests.
+func serveFile(c echo.Context, path, sha1sum, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	h := c.Response().Header()
+	h.Set("ETag", `"`+sha1sum+`"`)
+	h.Set(echo.HeaderContentDisposition, disposition(c.QueryParam("disposition"), name))
+
+	http.ServeContent(c.Response(), c.Request(), name, stat.ModTime(), f)
+	return nil
+}
+
+// Find a replica on a remote storage which has a configured filer.
+// It returns the URL of the file on that filer.
+func remoteReplica(sha1sum, name string) (*fileindex.FileRec, string, bool) {
+	cfg := getconf()
+
+	fl, ok := search(sha1sum)
+	if !ok || len(cfg.Remote) == 0 {
+		return nil, "", false
+	}
+	for _, fr := range srvCtx.Replicas.Rank(fl) {
+		if fr.Device == nil {
+			continue
+		}
+		if base, ok := cfg.Remote[fr.Device.Location]; ok {
+			return fr, fileutils.AddSlash(base) + sha1sum + "/" + url.PathEscape(name), true
+		}
+	}
+	return nil, "", false
+}
+
+// Stream a file from a remote filer. The content of a full response is
+// verified against sha1sum. The last block is held back until the
+// verification, so a client never receives a complete wrong file.
+func proxyFile(c echo.Context, rawurl, sha1sum, name string) error {
+	req, err := http.NewRequestWithContext(c.Request().Context(), c.Request().Method, rawurl, nil)
+	if err != nil {
+		log.Println("Proxy:", err)
+		return c.NoContent(http.StatusBadGateway)
+	}
+	for _, k := range proxyRequestHeaders {
+		if v := c.Request().Header.Get(k); v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		log.Println("Proxy:", err)
+		return c.NoContent(http.StatusBadGateway)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return c.NoContent(resp.StatusCode)
+	default:
+		log.Println("Proxy:", resp.Status, rawurl)
+		return c.NoContent(http.StatusBadGateway)
+	}
+
+	h := c.Response().Header()
+	for _, k := range proxyResponseHeaders {
+		if v := resp.Header.Get(k); v != "" {
+			h.Set(k, v)
+		}
+	}
+	h.Set("ETag", `"`+sha1sum+`"`)
+	h.Set(echo.HeaderContentDisposition, disposition(c.QueryParam("disposition"), name))
+	c.Response().WriteHeader(resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK || req.Method == http.MethodHead {
+		// partial content cannot be verified
+		io.Copy(c.Response(), resp.Body)
+		return nil
+	}
+
+	err = verifiedCopy(c.Response(), fileutils.NewSha1Reader(resp.Body), sha1sum)
+	if err != nil {
+		log.Println("Proxy:", err, rawurl)
+		// drop the connection, the client must not accept the content
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+func verifiedCopy(w io.Writer, r *fileutils.Sha1Reader, sha1sum string) error {
+	buf := make([]byte, 64*1024)
+	held := make([]byte, 0, len(buf))
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if len(held) > 0 {
+				if _, err := w.Write(held); err != nil {
+					return err
+				}
+			}
+			held, buf = buf[:n], held[:cap(held)]
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !strings.EqualFold(r.Sha1Str(), sha1sum) {
+		return errProxySha1
+	}
+	_, err := w.Write(held)
+	return err
+}
@@ -73,13 +73,13 @@ func LoadMap(r *bufio.Reader, filter FilterFunc) (FileMap, error) {
 	return fl, err
 }
 
-func LoadSyncMap(r *bufio.Reader, filter FilterFunc) (sync.Map, error) {
-	var fl sync.Map
+func LoadSyncMap(r *bufio.Reader, filter FilterFunc) (*sync.Map, error) {
+	fl := new(sync.Map)
 	err := load(r, filter, func(fr *FileRec) {
 		fl.Store(fr.Path, fr)
 	})
 	if err != nil {
-		fl = sync.Map{}
+		fl = new(sync.Map)
 	}
 	return fl, err
 }
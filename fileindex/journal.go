@@ -0,0 +1,149 @@
+package fileindex
+
+import (
+	"bufio"
+	"os"
+	"sync"
+)
+
+// Journal is an append-only local file of records in the format of index files.
+// It keeps records added at runtime until the index files contain them.
+type Journal struct {
+	sync.Mutex
+	path  string
+	list  FileList
+	index map[string]int // path -> position in list
+}
+
+// Open the journal at path and load its records using filter.
+// A missing file is an empty journal.
+func OpenJournal(path string, filter FilterFunc) (*Journal, error) {
+	j := &Journal{path: path, list: make(FileList, 0), index: make(map[string]int)}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return j, nil
+		}
+		return j, err
+	}
+	defer f.Close()
+
+	err = load(bufio.NewReader(f), filter, func(fr *FileRec) {
+		j.add(fr)
+	})
+	return j, err
+}
+
+// Append a record to the journal file
+func (j *Journal) Append(fr *FileRec) error {
+	j.Lock()
+	defer j.Unlock()
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = FileList{fr}.Save(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		j.add(fr)
+	}
+	return err
+}
+
+// Compact removes records whose SHA1 fs already has (at any path), whose
+// path fs has a newer version of, and records of files which have been moved,
+// deleted or changed since. It rewrites the journal file and returns the
+// number of removed records.
+func (j *Journal) Compact(fs *FastSearch) (int, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	keep := make(FileList, 0, len(j.list))
+	for _, fr := range j.list {
+		if _, ok := fs.Search(fr.Sha1); ok {
+			continue
+		}
+		if found, ok := fs.SearchPath(fr.Path); ok && found.Mtime >= fr.Mtime {
+			continue
+		}
+		if stale(fr) {
+			continue
+		}
+		keep = append(keep, fr)
+	}
+
+	n := len(j.list) - len(keep)
+	if n == 0 {
+		return 0, nil
+	}
+
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	err = keep.Save(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	j.list = keep
+	j.index = make(map[string]int, len(keep))
+	for i, fr := range keep {
+		j.index[fr.Path] = i
+	}
+	return n, nil
+}
+
+// Records of the journal
+func (j *Journal) Records() FileList {
+	j.Lock()
+	defer j.Unlock()
+
+	fl := make(FileList, len(j.list))
+	copy(fl, j.list)
+	return fl
+}
+
+// Replay all records of the journal on top of fs
+func (j *Journal) Replay(fs *FastSearch) {
+	for _, fr := range j.Records() {
+		fs.Update(fr)
+	}
+}
+
+// add keeps only the latest record of a path
+func (j *Journal) add(fr *FileRec) {
+	if i, ok := j.index[fr.Path]; ok {
+		j.list[i] = fr
+		return
+	}
+	j.index[fr.Path] = len(j.list)
+	j.list = append(j.list, fr)
+}
+
+// The file of the record is missing or changed. An unreachable file is kept.
+func stale(fr *FileRec) bool {
+	fi, err := os.Stat(fr.Path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	return fi.Size() != fr.Size || fi.ModTime().Unix() != fr.Mtime
+}
@@ -0,0 +1,77 @@
+package fileindex
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal")
+
+	j, err := OpenJournal(path, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// records of existing files
+	file := func(name, sha1 string) *FileRec {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(name+sha1), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fi, _ := os.Stat(p)
+		return &FileRec{Path: p, Sha1: sha1, Size: fi.Size(), Mtime: fi.ModTime().Unix()}
+	}
+	l := FileList{file("a", "aaa"), file("b", "bbb"), file("c", "ccc")}
+	for _, fr := range l {
+		if err := j.Append(fr); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	// the latest record of a path replaces the previous one
+	fr := file("c", "ddd")
+	if err := j.Append(fr); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	j, err = OpenJournal(path, nil)
+	if err != nil {
+		t.Fatalf("Reopen: %v", err)
+	}
+	if fl := j.Records(); len(fl) != 3 || fl[2].Sha1 != fr.Sha1 {
+		t.Errorf("Journal records = %v, expected 3 with the latest %s", fl, fr.Path)
+	}
+
+	// a is indexed at its path, b at another path
+	fs := NewFastSearch()
+	moved := *l[1]
+	moved.Path = "/net/server/r/b"
+	fs.AddList(FileList{l[0], &moved})
+	n, err := j.Compact(fs)
+	if err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Compacted records = %d, expected 2", n)
+	}
+
+	j, _ = OpenJournal(path, nil)
+	fl := j.Records()
+	if len(fl) != 1 || !fl[0].Equal(fr) {
+		t.Errorf("Journal after compact = %v, expected %v", fl, fr)
+	}
+
+	j.Replay(fs)
+	if _, ok := fs.Search(fr.Sha1); !ok {
+		t.Errorf("Replayed record %s not found", fr.Sha1)
+	}
+
+	// the file has been moved away
+	os.Remove(fr.Path)
+	if n, _ := j.Compact(NewFastSearch()); n != 1 || len(j.Records()) != 0 {
+		t.Errorf("Compacted records of a removed file = %d, left %d, expected 1 and 0", n, len(j.Records()))
+	}
+}
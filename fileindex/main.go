@@ -28,6 +28,12 @@ type (
 		pathmap FileMap
 	}
 
+	SearchStats struct {
+		Records int
+		SHA1s   int
+		Paths   int
+	}
+
 	Storage struct {
 		Id       string `json:"id" form:"id"`
 		Status   string `json:"status" form:"status"`
@@ -0,0 +1,72 @@
+package fileindex
+
+import (
+	"os"
+	"sort"
+)
+
+type (
+	// ReplicaPolicy orders replicas of a file from the most to the least preferred
+	ReplicaPolicy interface {
+		Rank(fl FileList) FileList
+	}
+
+	// StoragePolicy ranks replicas by storage status (online > nearline > offline),
+	// access (local > internet) and prefers the own location.
+	StoragePolicy struct {
+		Location string
+	}
+)
+
+var (
+	statusRank = map[string]int{"online": 0, "nearline": 1, "offline": 2}
+	accessRank = map[string]int{"local": 0, "internet": 1}
+)
+
+func rank(m map[string]int, key string) int {
+	if r, ok := m[key]; ok {
+		return r
+	}
+	return len(m)
+}
+
+func (p StoragePolicy) less(a, b *FileRec) bool {
+	if a.Device == nil || b.Device == nil {
+		return a.Device != nil
+	}
+	if x, y := rank(statusRank, a.Device.Status), rank(statusRank, b.Device.Status); x != y {
+		return x < y
+	}
+	if x, y := rank(accessRank, a.Device.Access), rank(accessRank, b.Device.Access); x != y {
+		return x < y
+	}
+	return a.Device.Location == p.Location && b.Device.Location != p.Location
+}
+
+// Rank returns a sorted copy of fl. Equal replicas keep the index order.
+func (p StoragePolicy) Rank(fl FileList) FileList {
+	rl := make(FileList, len(fl))
+	copy(rl, fl)
+	sort.SliceStable(rl, func(i, j int) bool {
+		return p.less(rl[i], rl[j])
+	})
+	return rl
+}
+
+// Choose the first replica ranked by p which is accepted by verify.
+// The nil verify accepts any replica.
+func Choose(p ReplicaPolicy, fl FileList, verify FilterFunc) (*FileRec, bool) {
+	for _, fr := range p.Rank(fl) {
+		if verify == nil || verify(fr) {
+			return fr, true
+		}
+	}
+	return nil, false
+}
+
+// VerifyLocal checks that the replica is a regular file on this machine
+// and has the expected size
+func VerifyLocal(fr *FileRec) bool {
+	stat, err := os.Stat(fr.Path)
+	return err == nil && stat.Mode().IsRegular() && stat.Size() == fr.Size
+}
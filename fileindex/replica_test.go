@@ -0,0 +1,57 @@
+package fileindex
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoragePolicy(t *testing.T) {
+	tape := &Storage{Id: "ltfs-001", Status: "offline", Access: "local", Location: "merkaz"}
+	disk := &Storage{Id: "disk-001", Status: "nearline", Access: "local", Location: "merkaz"}
+	remote := &Storage{Id: "nl", Status: "online", Access: "internet", Location: "nforce"}
+	other := &Storage{Id: "ru", Status: "online", Access: "local", Location: "piter"}
+	own := &Storage{Id: "nas-1", Status: "online", Access: "local", Location: "merkaz"}
+
+	fl := FileList{
+		{Path: "/tape", Device: tape},
+		{Path: "/none"},
+		{Path: "/disk", Device: disk},
+		{Path: "/remote", Device: remote},
+		{Path: "/other", Device: other},
+		{Path: "/own", Device: own},
+	}
+	expect := []string{"/own", "/other", "/remote", "/disk", "/tape", "/none"}
+
+	rl := StoragePolicy{Location: "merkaz"}.Rank(fl)
+	for i, fr := range rl {
+		if fr.Path != expect[i] {
+			t.Errorf("Rank %d = %s, expected %s", i, fr.Path, expect[i])
+		}
+	}
+	if fl[0].Path != "/tape" {
+		t.Errorf("Rank modified the source list")
+	}
+}
+
+func TestChoose(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	os.WriteFile(path, []byte("content"), 0644)
+
+	st := &Storage{Status: "online", Access: "local"}
+	fl := FileList{
+		{Path: filepath.Join(dir, "missing"), Size: 7, Device: st},
+		{Path: path, Size: 100, Device: st},
+		{Path: path, Size: 7, Device: st},
+	}
+
+	fr, ok := Choose(StoragePolicy{}, fl, VerifyLocal)
+	if !ok || fr != fl[2] {
+		t.Errorf("Choose = %v, expected %v", fr, fl[2])
+	}
+
+	if _, ok := Choose(StoragePolicy{}, fl[:2], VerifyLocal); ok {
+		t.Errorf("Choose found a replica, expected none")
+	}
+}
@@ -32,6 +32,25 @@ func (fs *FastSearch) GetAll() (fl []FileList) {
 	return
 }
 
+// Contains reports whether fs has a record equal to fr
+func (fs *FastSearch) Contains(fr *FileRec) bool {
+	for _, x := range fs.sha1map[fr.Sha1] {
+		if x.Equal(fr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats counts records, distinct SHA1s and paths of fs
+func (fs *FastSearch) Stats() SearchStats {
+	st := SearchStats{SHA1s: len(fs.sha1map), Paths: len(fs.pathmap)}
+	for _, fl := range fs.sha1map {
+		st.Records += len(fl)
+	}
+	return st
+}
+
 func (fs *FastSearch) Duplicate() *FastSearch {
 	fsdup := FastSearch{
 		sha1map: make(map[string]FileList, len(fs.sha1map)),
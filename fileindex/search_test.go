@@ -52,6 +52,21 @@ func TestAddList(t *testing.T) {
 	check(t, fs, 0, totalrecords)
 }
 
+func TestStats(t *testing.T) {
+	fs := newfs()
+	if st := fs.Stats(); st.SHA1s != totalrecords || st.Records != totalrecords || st.Paths != 0 {
+		t.Errorf("Stats = %+v, expected %d records and SHA1s", st, totalrecords)
+	}
+
+	// a duplicate is one more record of the same SHA1
+	fr := *ll[0][0]
+	fr.Path += ".dup"
+	fs.AddList(FileList{&fr})
+	if st := fs.Stats(); st.SHA1s != totalrecords || st.Records != totalrecords+1 {
+		t.Errorf("Stats = %+v, expected %d records of %d SHA1s", st, totalrecords+1, totalrecords)
+	}
+}
+
 func TestRemove(t *testing.T) {
 	fs := newfs()
 
@@ -50,7 +50,8 @@ func ReaddirMatch(path string, filter FileFilter) (dir Directory, err error) {
 	return Directory{path, fl}, nil
 }
 
-// Collect files recursively
+// Collect files recursively. The error of an unreadable subfolder is
+// returned with the files of the rest.
 func Collect(path string) (FileTree, error) {
 	ft := make(FileTree, 0)
 	dir, err := Readdir(path)
@@ -62,8 +63,9 @@ func Collect(path string) (FileTree, error) {
 	for _, fi := range dir.List {
 		if fi.IsDir() {
 			f, e := Collect(dir.Path + "/" + fi.Name())
-			if e == nil {
-				ft = append(ft, f...)
+			ft = append(ft, f...)
+			if e != nil && err == nil {
+				err = e
 			}
 		}
 		if fi.Mode().IsRegular() {
@@ -72,7 +74,7 @@ func Collect(path string) (FileTree, error) {
 	}
 	ft = append(ft, Directory{path, fl})
 
-	return ft, nil
+	return ft, err
 }
 
 func (dir Directory) FullPath(fi os.FileInfo) string {
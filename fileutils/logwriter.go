@@ -1,29 +1,40 @@
 package fileutils
 
 import (
+	"io"
 	"os"
 )
 
 // LogWriter
 
 func NewLogWriter(ctx LogCtx) *LogWriter {
-	var err error
-
-	if ctx.Path == "" {
-		ctx.out = os.Stderr
-	} else {
-		ctx.out, err = os.OpenFile(ctx.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			ctx.out = os.Stderr
-		}
-	}
+	ctx.out, _ = openLog(ctx.Path)
 
 	return &LogWriter{
 		ctx: ctx,
 	}
 }
 
+// An empty path or an error is stderr
+func openLog(path string) (io.WriteCloser, error) {
+	if path == "" {
+		return os.Stderr, nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return os.Stderr, err
+	}
+	return f, nil
+}
+
 func (lw *LogWriter) Close() (err error) {
+	lw.Lock()
+	defer lw.Unlock()
+
+	return lw.close()
+}
+
+func (lw *LogWriter) close() (err error) {
 	if lw.ctx.out == nil || lw.ctx.out == os.Stderr {
 		err = nil
 	} else {
@@ -33,7 +44,34 @@ func (lw *LogWriter) Close() (err error) {
 	return
 }
 
+// Reopen the log at path, the same or a new one (e.g. after rotation).
+// The log is kept if path cannot be opened.
+func (lw *LogWriter) Reopen(path string) error {
+	out, err := openLog(path)
+	if err != nil {
+		return err
+	}
+
+	lw.Lock()
+	defer lw.Unlock()
+
+	lw.close()
+	lw.ctx.Path = path
+	lw.ctx.out = out
+	return nil
+}
+
+func (lw *LogWriter) Path() string {
+	lw.Lock()
+	defer lw.Unlock()
+
+	return lw.ctx.Path
+}
+
 func (lw *LogWriter) Write(b []byte) (n int, err error) {
+	lw.Lock()
+	defer lw.Unlock()
+
 	n, err = lw.ctx.out.Write(b)
 	return
 }
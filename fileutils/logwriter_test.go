@@ -0,0 +1,37 @@
+package fileutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogWriterReopen(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.log")
+	second := filepath.Join(dir, "second.log")
+
+	lw := NewLogWriter(LogCtx{Path: first})
+	defer lw.Close()
+	lw.Write([]byte("one\n"))
+
+	if err := lw.Reopen(second); err != nil {
+		t.Fatalf("Reopen: %v", err)
+	}
+	lw.Write([]byte("two\n"))
+
+	if err := lw.Reopen(filepath.Join(dir, "none", "x.log")); err == nil {
+		t.Errorf("Reopen of a wrong path: no error")
+	}
+	lw.Write([]byte("three\n"))
+
+	if b, _ := os.ReadFile(first); string(b) != "one\n" {
+		t.Errorf("First log = %q, expected %q", b, "one\n")
+	}
+	if b, _ := os.ReadFile(second); string(b) != "two\nthree\n" {
+		t.Errorf("Second log = %q, expected %q", b, "two\nthree\n")
+	}
+	if lw.Path() != second {
+		t.Errorf("Path = %s, expected %s", lw.Path(), second)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -31,6 +32,7 @@ type (
 	}
 
 	LogWriter struct {
+		sync.Mutex
 		ctx LogCtx
 	}
 )
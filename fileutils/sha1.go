@@ -93,7 +93,7 @@ func NewSha1Reader(r io.Reader) *Sha1Reader {
 
 func (r *Sha1Reader) Read(b []byte) (n int, err error) {
 	n, err = r.Reader.Read(b)
-	if err == nil {
+	if n > 0 {
 		r.xx.Write(b[:n])
 	}
 	return n, err
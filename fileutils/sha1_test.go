@@ -0,0 +1,21 @@
+package fileutils
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSha1Reader(t *testing.T) {
+	const expect = "a9993e364706816aba3e25717850c26c9cd0d89d" // SHA1 of "abc"
+
+	// the last data is returned together with io.EOF
+	r := NewSha1Reader(iotest.DataErrReader(strings.NewReader("abc")))
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if r.Sha1Str() != expect {
+		t.Errorf("SHA1 = %s, expected %s", r.Sha1Str(), expect)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/Bnei-Baruch/filer-backend/fileutils"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	HealthResp struct {
+		Status     string          `json:"status"` // "ok" or "not ready"
+		Ready      bool            `json:"ready"`
+		Index      IndexHealth     `json:"index"`
+		Paths      []PathHealth    `json:"paths"`
+		TransWork  *PathHealth     `json:"transwork,omitempty"`
+		Transcoder WorkersHealth   `json:"transcoder"`
+		Binaries   map[string]bool `json:"binaries"`
+	}
+
+	IndexHealth struct {
+		Records int        `json:"records"`
+		SHA1s   int        `json:"sha1s"`
+		Loaded  *time.Time `json:"loaded,omitempty"`
+		Age     float64    `json:"age"` // seconds since the last load
+	}
+
+	PathHealth struct {
+		Name      string `json:"name"`
+		Path      string `json:"path"`
+		Reachable bool   `json:"reachable"`
+		Free      int64  `json:"free,omitempty"`
+		Error     string `json:"error,omitempty"`
+	}
+
+	WorkersHealth struct {
+		Workers int `json:"workers"`
+		Running int `json:"running"`
+		Queue   int `json:"queue"`
+	}
+
+	// stat in progress, probes of the path wait for it
+	statCall struct {
+		start time.Time
+		done  chan struct{}
+		err   error
+	}
+)
+
+// A stat of a hung network mount must not hang the health check
+const statTimeout = 2 * time.Second
+
+var (
+	errStatTimeout = errors.New("Timeout")
+
+	// at most one stat of a path, a hung one is not repeated until it returns
+	statMu    sync.Mutex
+	statCalls = make(map[string]*statCall)
+)
+
+func statPath(name, path string) PathHealth {
+	ph := PathHealth{Name: name, Path: path}
+
+	statMu.Lock()
+	call, ok := statCalls[path]
+	if !ok {
+		call = &statCall{start: time.Now(), done: make(chan struct{})}
+		statCalls[path] = call
+		go func() {
+			_, call.err = os.Stat(path)
+			statMu.Lock()
+			delete(statCalls, path)
+			statMu.Unlock()
+			close(call.done)
+		}()
+	}
+	statMu.Unlock()
+
+	// a hung stat is reported at once
+	timer := time.NewTimer(statTimeout - time.Since(call.start))
+	defer timer.Stop()
+	var err error
+	select {
+	case <-call.done:
+		err = call.err
+	case <-timer.C:
+		err = errStatTimeout
+	}
+	if err != nil {
+		ph.Error = err.Error()
+	} else {
+		ph.Reachable = true
+	}
+	return ph
+}
+
+func health() HealthResp {
+	cfg := getconf()
+
+	st := srvCtx.Index.Stats()
+	loaded := srvCtx.Index.LoadTime()
+	// ready after the first load of a non-empty index
+	res := HealthResp{
+		Status: "ok",
+		Ready:  !loaded.IsZero() && st.Records > 0,
+		Index:  IndexHealth{Records: st.Records, SHA1s: st.SHA1s},
+		Paths: []PathHealth{
+			statPath("archive", cfg.BasePathArchive),
+			statPath("original", cfg.BasePathOriginal),
+		},
+		Binaries: make(map[string]bool),
+	}
+	if !res.Ready {
+		res.Status = "not ready"
+	}
+	if !loaded.IsZero() {
+		res.Index.Loaded = &loaded
+		res.Index.Age = time.Since(loaded).Seconds()
+	}
+	if cfg.TransWork != "" {
+		ph := statPath("transwork", cfg.TransWork)
+		if ph.Reachable {
+			ph.Free = fileutils.DiskAvailable(cfg.TransWork)
+		}
+		res.TransWork = &ph
+	}
+	ts := srvCtx.Trans.Status()
+	res.Transcoder = WorkersHealth{Workers: ts.Workers, Running: ts.Running, Queue: ts.Queue}
+	for _, bin := range []string{"ffmpeg", "ffprobe"} {
+		_, err := exec.LookPath(bin)
+		res.Binaries[bin] = err == nil
+	}
+	return res
+}
+
+// GET /healthz
+func getHealth(c echo.Context) error {
+	return c.JSON(http.StatusOK, health())
+}
+
+// GET /readyz
+func getReady(c echo.Context) error {
+	res := health()
+	if !res.Ready {
+		return c.JSON(http.StatusServiceUnavailable, res)
+	}
+	return c.JSON(http.StatusOK, res)
+}
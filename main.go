@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -9,11 +13,15 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Bnei-Baruch/filer-backend/apikey"
 	"github.com/Bnei-Baruch/filer-backend/fileindex"
 	"github.com/Bnei-Baruch/filer-backend/fileutils"
+	"github.com/Bnei-Baruch/filer-backend/notify"
+	"github.com/Bnei-Baruch/filer-backend/signing"
 	"github.com/Bnei-Baruch/filer-backend/transcode"
 
-	"github.com/pelletier/go-toml"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 )
 
 type (
@@ -25,36 +33,73 @@ type (
 
 	IndexList []IndexFile
 
+	// Changes of the index since the last published load
+	pendingChanges struct {
+		base  *fileindex.FastSearch // index of the last published load, nil if unknown
+		sha1s map[string]bool       // changed SHA1s, nil if all
+	}
+
 	IndexMain struct {
 		sync.Mutex
-		List IndexList
-		fs   *fileindex.FastSearch
-		Path string
+		List      IndexList
+		fs        *fileindex.FastSearch
+		Path      string
+		Journal   *fileindex.Journal     // records added at runtime (optional)
+		Events    *notify.Webhooks       // subscribers of index changes (optional)
+		Published string                 // records of the last published events
+		pending   *pendingChanges        // not published by incomplete loads
+		loaded    time.Time              // time of the last Load
+		stats     *fileindex.SearchStats // of fs
 	}
 
+	CORSPolicy map[string]middleware.CORSConfig
+
 	ServerConf struct {
 		BasePathArchive  string
 		BasePathOriginal string
 		BaseURL          string // base URL of the secure file access
 		GetFileExpire    time.Duration
 		Listen           string
-		NotifyStation    string // notify station
-		NotifyUser       string // notify user
-		TransDest        string // target folder for transcoded files
-		TransNotify      string // notify MDB app
-		TransWork        string // working folder for transcoder
-		VerifyDownload   bool   // verify registration for downloads
+		StopOnUpdate     bool              // upgrade when the executable is updated
+		ShutdownTimeout  time.Duration     // grace period of requests and notifications on shutdown
+		UpgradeTimeout   time.Duration     // wait for the upgraded process to load the index
+		Remote           map[string]string // location -> base URL of the remote filer
+		RemoteMode       string            // "proxy" or "redirect" to a remote filer
+		Signing          *signing.Keys     // keys of signed download URLs
+		APIKeys          *apikey.Keys      // keys of the mutating API (optional)
+		CORS             CORSPolicy        // CORS configs by route group
+		NotifyAuth       *notify.Auth      // authentication of notifications (optional)
+		NotifyStation    string            // notify station
+		NotifyTimeout    time.Duration     // timeout of a notify request
+		NotifyAttempts   int               // max attempts of delivery from the outbox
+		NotifyBackoff    time.Duration     // delay after the first failed delivery
+		NotifyOutbox     string            // folder of undelivered notifications
+		NotifyUser       string            // notify user
+		TransDest        string            // target folder for transcoded files
+		TransNotify      string            // notify MDB app
+		TransTolerance   float64           // max difference of durations of a source and a transcoded file, s
+		TransWork        string            // working folder for transcoder
+		TrustedProxies   []*net.IPNet      // proxies allowed to set X-Forwarded-For
+		VerifyDownload   bool              // verify registration for downloads
 	}
 
 	TranscoderConf struct {
-		Concurrency int // max number of concurrent transcoding processes
+		Concurrency int                          // max number of concurrent transcoding processes
+		KeepJobs    time.Duration                // keep finished jobs
+		StopTimeout time.Duration                // wait for running tasks on shutdown, then requeue them
+		Reserve     int64                        // min free space of transwork and transdest, bytes
+		Presets     map[string]*transcode.Preset // builtin and configured presets
 	}
 
 	ServerCtx struct {
-		Config *ServerConf
-		Index  *IndexMain
-		Update chan string
-		Trans  transcode.Transcoder
+		Config   *ServerConf
+		Index    *IndexMain
+		Update   chan string
+		Trans    transcode.Transcoder
+		Jobs     *transcode.JobStore
+		Outbox   *notify.Outbox
+		Presets  map[string]*transcode.Preset
+		Replicas fileindex.ReplicaPolicy
 	}
 
 	UpdateConf struct {
@@ -66,6 +111,33 @@ type (
 		Config *UpdateConf
 		Index  *IndexMain
 		Update chan string
+		Reload chan time.Duration // new rescan interval
+	}
+
+	Conf struct {
+		Index      IndexConf
+		Events     EventsConf
+		Location   LocationConf
+		Server     ServerConf
+		Transcoder TranscoderConf
+		Update     UpdateConf
+		Log        string // path of the log, stderr if empty
+	}
+
+	IndexConf struct {
+		Dir     string
+		Journal string // records added at runtime (optional)
+	}
+
+	// Webhooks of index changes
+	EventsConf struct {
+		Hooks    []notify.Webhook
+		Outbox   string // folder of undelivered events
+		State    string // records of the last published events
+		Auth     *notify.Auth
+		Timeout  time.Duration
+		Attempts int
+		Backoff  time.Duration
 	}
 
 	LocationConf struct {
@@ -81,31 +153,18 @@ const (
 	globalConf = "/etc/filer_storage.conf"
 )
 
-func configLoad() *toml.Tree {
-	home := os.Getenv("HOME")
-	config, err := toml.LoadFile(home + "/" + localConf)
-	if err != nil {
-		if os.IsNotExist(err) {
-			config, err = toml.LoadFile(globalConf)
-		}
-		if err != nil {
-			log.Fatalln("Load config file: ", err)
-		}
-	}
-	return config
-}
-
 func signalHandler() chan os.Signal {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan,
 		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
-		syscall.SIGQUIT)
+		syscall.SIGQUIT,
+		syscall.SIGUSR2)
 	return signalChan
 }
 
-// Stop the program in case the executable file is updated
+// Upgrade the program in case the executable file is updated
 func stoponupdate(ch chan os.Signal) {
 	prog, _ := filepath.Abs(os.Args[0])
 	stat, _ := os.Stat(prog)
@@ -117,70 +176,218 @@ func stoponupdate(ch chan os.Signal) {
 			if time.Since(s.ModTime()) < time.Second*2 {
 				continue
 			}
-			if s.ModTime() != stat.ModTime() {
-				log.Println("Stop on update")
-				ch <- syscall.SIGQUIT
-				break
+			// a failed upgrade is retried when the executable is updated again
+			if stat == nil || s.ModTime() != stat.ModTime() {
+				log.Println("Upgrade on update")
+				ch <- syscall.SIGUSR2
+				stat = s
 			}
 		}
 	}
 }
 
-var conf struct {
-	Location   LocationConf
-	Server     ServerConf
-	Transcoder TranscoderConf
-	Update     UpdateConf
-}
+var conf Conf
 
 func main() {
-	signalChan := signalHandler()
+	check := flag.Bool("check-config", false, "validate the config file (the argument or the default one) and exit")
+	flag.Parse()
+	if *check {
+		os.Exit(checkConfig(flag.Arg(0)))
+	}
 
-	config := configLoad()
-	conf.Server.BasePathArchive = config.Get("server.basepath.Archive").(string)
-	conf.Server.BasePathOriginal = config.Get("server.basepath.Original").(string)
-	conf.Server.BaseURL = config.Get("server.baseurl").(string)
-	conf.Server.Listen = config.Get("server.listen").(string)
-	conf.Server.GetFileExpire = time.Duration(config.GetDefault("server.getfileexpire", int64(7200)).(int64)) * time.Second
-	conf.Server.VerifyDownload = config.GetDefault("server.verifydownload", false).(bool)
+	signalChan := signalHandler()
 
-	conf.Server.TransNotify = config.GetDefault("mdbapp.api", "").(string)
-	conf.Server.NotifyStation = config.GetDefault("mdbapp.station", "").(string)
-	conf.Server.NotifyUser = config.GetDefault("mdbapp.user", "").(string)
+	config, err := configLoad("")
+	if err != nil {
+		log.Fatalln("Load config file: ", err)
+	}
+	c, err := parseConfig(config)
+	if err != nil {
+		log.Fatalln("Config:\n" + err.Error())
+	}
+	conf = *c
 
-	conf.Location.Access = config.GetDefault("location.access", "local").(string)
-	conf.Location.Country = config.GetDefault("location.country", "unknown").(string)
-	conf.Location.Name = config.GetDefault("location.name", "unknown").(string)
-	conf.Location.Hostname = fileutils.BaseHostName()
+	logWriter := fileutils.NewLogWriter(fileutils.LogCtx{Path: conf.Log})
+	log.SetOutput(logWriter)
 
-	conf.Update.BaseDir = config.GetDefault("update.basedir", "/").(string)
-	conf.Update.Reload = time.Duration(config.GetDefault("update.reload", int64(10)).(int64)) * time.Second
+	InitStorages()
 
-	conf.Transcoder.Concurrency = int(config.GetDefault("transcoder.concurrency", int64(0)).(int64))
-	if conf.Transcoder.Concurrency > 0 {
-		conf.Server.TransDest = fileutils.AddSlash(config.Get("server.transdest").(string))
-		conf.Server.TransWork = fileutils.AddSlash(config.Get("server.transwork").(string))
+	index := NewIndex(conf.Index.Dir)
+	if conf.Index.Journal != "" {
+		j, err := fileindex.OpenJournal(conf.Index.Journal, func(fr *fileindex.FileRec) bool {
+			return filter(fr, nil)
+		})
+		if err != nil {
+			log.Println("Journal:", err)
+		}
+		index.Journal = j
 	}
 
-	log.SetOutput(fileutils.NewLogWriter(fileutils.LogCtx{
-		Path: config.GetDefault("server.log", "").(string),
-	}))
+	// outboxes are delivered until shutdown
+	stopOutbox := make(chan struct{})
 
-	InitStorages()
+	// webhooks of index changes are kept in their own outbox until delivered
+	if len(conf.Events.Hooks) > 0 {
+		events, err := notify.NewOutbox(conf.Events.Outbox)
+		if err != nil {
+			log.Fatalln("Webhooks outbox:", err)
+		}
+		events.Configure(conf.Events.Auth, conf.Events.Timeout, conf.Events.Attempts, conf.Events.Backoff)
+		go events.Run(stopOutbox)
+		index.Events = &notify.Webhooks{Hooks: conf.Events.Hooks, Outbox: events}
+		index.Published = conf.Events.State
+	}
 
-	index := NewIndex(config.Get("index.dir").(string))
 	index.Load()
 	update := make(chan string, 100)
 
-	tr := transcode.NewMultiTranscoder(conf.Transcoder.Concurrency)
+	var jobs *transcode.JobStore
+	var space *transcode.Space
+	if conf.Transcoder.Concurrency > 0 {
+		var err error
+		jobs, err = transcode.NewJobStore(conf.Server.TransWork+"jobs", conf.Transcoder.KeepJobs)
+		if err != nil {
+			log.Fatalln("Transcode jobs:", err)
+		}
+		space = &transcode.Space{
+			Dirs:    []string{conf.Server.TransWork, conf.Server.TransDest},
+			Reserve: conf.Transcoder.Reserve,
+		}
+	}
+	tr := transcode.NewMultiTranscoder(conf.Transcoder.Concurrency, jobs, space)
+
+	// notifications of MDB app are kept in the outbox until delivered
+	var outbox *notify.Outbox
+	outboxDir := conf.Server.NotifyOutbox
+	if outboxDir == "" && conf.Server.TransWork != "" {
+		outboxDir = conf.Server.TransWork + "outbox"
+	}
+	if outboxDir != "" && conf.Server.TransNotify != "" {
+		var err error
+		outbox, err = notify.NewOutbox(outboxDir)
+		if err != nil {
+			log.Fatalln("Notify outbox:", err)
+		}
+		outbox.Configure(conf.Server.NotifyAuth, conf.Server.NotifyTimeout, conf.Server.NotifyAttempts, conf.Server.NotifyBackoff)
+		go outbox.Run(stopOutbox)
+	}
+
+	replicas := fileindex.StoragePolicy{Location: conf.Location.Name}
 
-	go webServer(ServerCtx{Config: &conf.Server, Index: index, Update: update, Trans: tr})
-	go updateServer(UpdateCtx{Config: &conf.Update, Index: index, Update: update})
-	go transcodeResult(tr)
+	outboxes := map[string]*notify.Outbox{"mdbapp": outbox}
+	if index.Events != nil {
+		outboxes["events"] = index.Events.Outbox
+	}
+	registerMetrics(index, update, tr, outboxes)
 
-	if config.GetDefault("server.stoponupdate", false).(bool) == true {
+	setHandoff(upgraded())
+	l, err := listen(conf.Server.Listen)
+	if err != nil {
+		log.Fatalln("Listen:", err)
+	}
+	srvConf := conf.Server
+	e := webServer(ServerCtx{Config: &srvConf, Index: index, Update: update, Trans: tr, Jobs: jobs, Outbox: outbox, Presets: conf.Transcoder.Presets, Replicas: replicas})
+	e.Listener = l
+	go func() {
+		if err := e.Start(""); err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+	updConf := conf.Update
+	updReload := make(chan time.Duration, 1)
+	go updateServer(UpdateCtx{Config: &updConf, Index: index, Update: update, Reload: updReload})
+	results := make(chan struct{})
+	go func() {
+		transcodeResult(tr)
+		close(results)
+	}()
+	// the old process hands over the jobs after this one is ready
+	go func() {
+		if waitRelease() && jobs != nil {
+			if err := jobs.Reload(); err != nil {
+				log.Println("Transcode jobs:", err)
+			}
+		}
+		setHandoff(false)
+		if jobs != nil {
+			transcodeResume(tr, jobs)
+		}
+	}()
+	// an upgrade without the index is killed by the old process on timeout
+	if n := index.Stats().Records; n > 0 {
+		reportReady(n)
+	} else if upgraded() {
+		log.Println("Upgrade: the index is empty, not ready")
+	}
+
+	if conf.Server.StopOnUpdate {
 		go stoponupdate(signalChan)
 	}
 
-	_ = <-signalChan
+	for {
+		sig := <-signalChan
+		if sig == syscall.SIGHUP {
+			reload(tr, outbox, logWriter, updReload)
+			continue
+		}
+		if sig != syscall.SIGUSR2 {
+			log.Println("Shutdown:", sig)
+			break
+		}
+
+		// the new process takes over the socket, then the jobs
+		log.Println("Upgrade:", os.Args[0])
+		setHandoff(true)
+		release, err := upgrade(l, conf.Server.UpgradeTimeout)
+		if err != nil {
+			log.Println("Upgrade failed:", err)
+			setHandoff(false)
+			continue
+		}
+		stopTranscoder(tr, results)
+		release.Close()
+		log.Println("Shutdown: upgraded")
+		break
+	}
+
+	flush := make([]*notify.Outbox, 0, len(outboxes))
+	for _, o := range outboxes {
+		if o != nil {
+			flush = append(flush, o)
+		}
+	}
+	shutdown(e, tr, results, flush, stopOutbox)
+}
+
+// Stop accepting requests and let downloads finish, let running transcodes
+// finish or requeue them, deliver pending notifications
+func shutdown(e *echo.Echo, tr transcode.Transcoder, results <-chan struct{}, outboxes []*notify.Outbox, stopOutbox chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Server.ShutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		log.Println("Shutdown (downloads interrupted):", err)
+		e.Close()
+	}
+
+	stopTranscoder(tr, results)
+
+	close(stopOutbox)
+	nctx, ncancel := context.WithTimeout(context.Background(), conf.Server.ShutdownTimeout)
+	defer ncancel()
+	for _, o := range outboxes {
+		if n := o.Flush(nctx); n > 0 {
+			log.Printf("Shutdown: %d notifications left in the outbox\n", n)
+		}
+	}
+	log.Println("Shutdown: done")
+}
+
+// Let running transcodes finish or requeue them, wait for their results
+func stopTranscoder(tr transcode.Transcoder, results <-chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Transcoder.StopTimeout)
+	defer cancel()
+	if n := tr.Stop(ctx); n > 0 {
+		log.Printf("Shutdown: %d transcodes requeued\n", n)
+	}
+	<-results
 }
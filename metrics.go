@@ -0,0 +1,171 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Bnei-Baruch/filer-backend/notify"
+	"github.com/Bnei-Baruch/filer-backend/transcode"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "filer"
+
+var (
+	indexLoadSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "index_load_duration_seconds",
+		Help:      "Duration of the last load of the index files.",
+	})
+	indexLoadTime = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "index_load_timestamp_seconds",
+		Help:      "Time of the last load of the index files.",
+	})
+	indexFileRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "index_file_records",
+		Help:      "Records loaded from an index file.",
+	}, []string{"file"})
+
+	hashFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hash_files_total",
+		Help:      "Files hashed by the update server.",
+	})
+	hashBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hash_bytes_total",
+		Help:      "Bytes hashed by the update server.",
+	})
+	hashSeconds = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hash_seconds_total",
+		Help:      "Time spent hashing by the update server.",
+	})
+
+	transcodeSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "transcode_duration_seconds",
+		Help:      "Running time of transcoding jobs.",
+		Buckets:   prometheus.ExponentialBuckets(10, 2, 10),
+	}, []string{"preset"})
+	transcodeJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "transcode_jobs_total",
+		Help:      "Finished transcoding jobs by the result: done, failed, canceled.",
+	}, []string{"preset", "result"})
+
+	downloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downloads_total",
+		Help:      "Downloads served by the storage of the file.",
+	}, []string{"storage"})
+	downloadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "download_bytes_total",
+		Help:      "Bytes sent to clients by the storage of the file.",
+	}, []string{"storage"})
+
+	notifyDirect = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "notify_direct_total",
+		Help:      "Notifications sent without the outbox by the result: success, failure.",
+	}, []string{"result"})
+)
+
+// Metrics which are read from the state of the server on scrape
+func registerMetrics(index *IndexMain, update chan string, tr transcode.Transcoder, outboxes map[string]*notify.Outbox) {
+	gauge := func(name, help string, f func() int) {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return float64(f()) })
+	}
+
+	gauge("index_records", "Records of the index.", func() int { return index.Stats().Records })
+	gauge("index_sha1s", "Distinct SHA1s of the index.", func() int { return index.Stats().SHA1s })
+	gauge("index_paths", "Paths of online files of the index.", func() int { return index.Stats().Paths })
+	gauge("update_backlog", "Paths waiting for the update server.", func() int { return len(update) })
+
+	gauge("transcode_queue_length", "Queued transcoding tasks.", func() int { return tr.Status().Queue })
+	gauge("transcode_running", "Running transcoding tasks.", func() int { return tr.Status().Running })
+	gauge("transcode_workers", "Transcoding workers.", func() int { return tr.Status().Workers })
+
+	for name, o := range outboxes {
+		if o == nil {
+			continue
+		}
+		o := o
+		counter := func(metric, help string, f func(st notify.Stats) uint64) {
+			promauto.NewCounterFunc(prometheus.CounterOpts{
+				Namespace:   metricsNamespace,
+				Name:        metric,
+				Help:        help,
+				ConstLabels: prometheus.Labels{"outbox": name},
+			}, func() float64 { return float64(f(o.Stats())) })
+		}
+		counter("notify_delivered_total", "Notifications delivered from the outbox.", func(st notify.Stats) uint64 { return st.Delivered })
+		counter("notify_failed_total", "Failed attempts to deliver notifications.", func(st notify.Stats) uint64 { return st.Failed })
+		counter("notify_dead_total", "Notifications given up after max attempts.", func(st notify.Stats) uint64 { return st.Dead })
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "notify_pending",
+			Help:        "Notifications waiting in the outbox.",
+			ConstLabels: prometheus.Labels{"outbox": name},
+		}, func() float64 { return float64(len(o.Pending())) })
+	}
+}
+
+// GET /metrics
+func getMetrics() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
+
+func observeIndexLoad(start time.Time, list IndexList) {
+	indexLoadSeconds.Set(time.Since(start).Seconds())
+	indexLoadTime.Set(float64(time.Now().Unix()))
+	indexFileRecords.Reset()
+	for _, f := range list {
+		indexFileRecords.WithLabelValues(f.Path).Set(float64(len(f.Files)))
+	}
+}
+
+func observeHash(start time.Time, size int64) {
+	hashFiles.Inc()
+	hashBytes.Add(float64(size))
+	hashSeconds.Add(time.Since(start).Seconds())
+}
+
+func observeTranscode(r *transcode.TranscodeResult, result string) {
+	preset := ""
+	if req, ok := r.Task.Ctx.(*TranscodeReq); ok {
+		preset = req.PresetName()
+	}
+	transcodeJobs.WithLabelValues(preset, result).Inc()
+	if r.Elapsed > 0 {
+		transcodeSeconds.WithLabelValues(preset).Observe(r.Elapsed.Seconds())
+	}
+}
+
+// Count the download after the response is sent
+func observeDownload(c echo.Context, storage string) {
+	status := c.Response().Status
+	if status != 200 && status != 206 {
+		return
+	}
+	downloads.WithLabelValues(storage).Inc()
+	downloadBytes.WithLabelValues(storage).Add(float64(c.Response().Size))
+}
+
+func observeNotify(err error) {
+	if err == nil {
+		notifyDirect.WithLabelValues("success").Inc()
+	} else {
+		notifyDirect.WithLabelValues("failure").Inc()
+	}
+}
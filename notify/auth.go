@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Auth identifies the sender of notifications with a bearer token
+// and/or an HMAC-SHA256 signature of the body
+type Auth struct {
+	Token  string
+	Secret []byte
+}
+
+// Headers of notifications
+const (
+	HeaderIdempotencyKey = "Idempotency-Key"
+	HeaderSignature      = "X-Filer-Signature"
+	HeaderTimestamp      = "X-Filer-Timestamp"
+)
+
+// Signature of the body sent at the timestamp (unix seconds):
+// hex HMAC-SHA256 of "timestamp.body"
+func Signature(secret []byte, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Apply the authentication headers to the request with the body
+func (a *Auth) Apply(req *http.Request, body []byte, now time.Time) {
+	if a == nil {
+		return
+	}
+	if a.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+	}
+	if len(a.Secret) > 0 {
+		ts := strconv.FormatInt(now.Unix(), 10)
+		req.Header.Set(HeaderTimestamp, ts)
+		req.Header.Set(HeaderSignature, Signature(a.Secret, ts, body))
+	}
+}
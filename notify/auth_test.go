@@ -0,0 +1,42 @@
+package notify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuth(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		if r.Header.Get(HeaderIdempotencyKey) != "job:sha1" {
+			t.Errorf("Idempotency key = %q", r.Header.Get(HeaderIdempotencyKey))
+		}
+		ts := r.Header.Get(HeaderTimestamp)
+		if x, err := strconv.ParseInt(ts, 10, 64); err != nil || now.Unix()-x > 60 {
+			t.Errorf("Timestamp = %q", ts)
+		}
+		if sign := Signature(secret, ts, []byte(`{"sha1":"abc"}`)); r.Header.Get(HeaderSignature) != sign {
+			t.Errorf("Signature = %q, expected %q", r.Header.Get(HeaderSignature), sign)
+		}
+	}))
+	defer srv.Close()
+
+	o, err := NewOutbox(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	o.Auth = &Auth{Token: "token", Secret: secret}
+	o.Send(srv.URL, "job:sha1", map[string]string{"sha1": "abc"})
+	o.deliver(time.Now())
+	if n := len(o.Pending()); n != 0 {
+		t.Errorf("Pending = %d, expected 0", n)
+	}
+}
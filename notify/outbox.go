@@ -0,0 +1,380 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+type (
+	// Message is a JSON document to POST to URL
+	Message struct {
+		ID       string          `json:"id"`
+		Key      string          `json:"key,omitempty"` // idempotency key
+		URL      string          `json:"url"`
+		Body     json.RawMessage `json:"body"`
+		Attempts int             `json:"attempts"`
+		Created  time.Time       `json:"created"`
+		Next     time.Time       `json:"next"`            // time of the next attempt
+		Error    string          `json:"error,omitempty"` // of the last attempt
+	}
+
+	// Outbox keeps messages as JSON files in a folder until they are delivered.
+	// Failed deliveries are retried with exponential backoff. Messages are moved
+	// to the "dead" subfolder after MaxAttempts.
+	Outbox struct {
+		sync.Mutex
+		Auth        *Auth
+		Client      *http.Client
+		MaxAttempts int
+		Backoff     time.Duration // delay after the first failure
+		MaxBackoff  time.Duration
+
+		dir     string
+		msgs    map[string]*Message
+		wake    chan struct{}
+		stats   Stats
+		sending sync.Mutex // one delivery at a time
+	}
+
+	// Stats counts delivery attempts since the start
+	Stats struct {
+		Delivered uint64
+		Failed    uint64 // failed attempts
+		Dead      uint64
+	}
+)
+
+const (
+	deadDir = "dead"
+	msgExt  = ".json"
+)
+
+var ErrNotFound = errors.New("Message not found")
+
+// Open the outbox in dir and load undelivered messages
+func NewOutbox(dir string) (*Outbox, error) {
+	o := &Outbox{
+		Client:      &http.Client{Timeout: 30 * time.Second},
+		MaxAttempts: 10,
+		Backoff:     30 * time.Second,
+		MaxBackoff:  time.Hour,
+		dir:         dir,
+		msgs:        make(map[string]*Message),
+		wake:        make(chan struct{}, 1),
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, deadDir), 0755); err != nil {
+		return nil, err
+	}
+	msgs, err := readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		o.msgs[msgs[i].ID] = &msgs[i]
+	}
+	return o, nil
+}
+
+// Send queues a message with the body encoded to JSON.
+// The receiver can use the key to skip duplicates.
+func (o *Outbox) Send(url, key string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	msg := &Message{
+		ID:      uuid.NewV4().String(),
+		Key:     key,
+		URL:     url,
+		Body:    b,
+		Created: now,
+		Next:    now,
+	}
+
+	o.Lock()
+	err = writeMessage(o.path(msg.ID), msg)
+	if err == nil {
+		o.msgs[msg.ID] = msg
+	}
+	o.Unlock()
+
+	o.notify()
+	return err
+}
+
+// Configure delivery of the running outbox. Zero values keep the current settings.
+// A delivery in progress uses the previous settings.
+func (o *Outbox) Configure(auth *Auth, timeout time.Duration, attempts int, backoff time.Duration) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.Auth = auth
+	if timeout > 0 {
+		o.Client = &http.Client{Timeout: timeout}
+	}
+	if attempts > 0 {
+		o.MaxAttempts = attempts
+	}
+	if backoff > 0 {
+		o.Backoff = backoff
+	}
+}
+
+// Run delivers messages until stop is closed
+func (o *Outbox) Run(stop <-chan struct{}) {
+	for {
+		next := o.deliver(time.Now())
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-o.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Pending returns undelivered messages
+func (o *Outbox) Pending() []Message {
+	o.Lock()
+	defer o.Unlock()
+
+	msgs := make([]Message, 0, len(o.msgs))
+	for _, msg := range o.msgs {
+		msgs = append(msgs, *msg)
+	}
+	sortMessages(msgs)
+	return msgs
+}
+
+func (o *Outbox) Stats() Stats {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.stats
+}
+
+// Dead returns messages that have not been delivered after MaxAttempts
+func (o *Outbox) Dead() ([]Message, error) {
+	return readDir(filepath.Join(o.dir, deadDir))
+}
+
+// Replay moves a dead message back to the outbox
+func (o *Outbox) Replay(id string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	dead := filepath.Join(o.dir, deadDir, id+msgExt)
+	msg, err := readMessage(dead)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	msg.Attempts = 0
+	msg.Next = time.Now()
+	if err := writeMessage(o.path(id), msg); err != nil {
+		return err
+	}
+	os.Remove(dead)
+	o.msgs[id] = msg
+
+	o.notify()
+	return nil
+}
+
+// Deliver the due messages. It returns the time of the next delivery.
+func (o *Outbox) deliver(now time.Time) time.Time {
+	o.sending.Lock()
+	defer o.sending.Unlock()
+
+	next := now.Add(o.MaxBackoff)
+	for _, msg := range o.Pending() {
+		if msg.Next.After(now) {
+			if msg.Next.Before(next) {
+				next = msg.Next
+			}
+			continue
+		}
+		if t, ok := o.attempt(context.Background(), &msg); !ok && t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// Flush tries to deliver all pending messages once, regardless of their
+// backoff, until ctx is done. It returns the number of undelivered messages.
+func (o *Outbox) Flush(ctx context.Context) int {
+	o.sending.Lock()
+	defer o.sending.Unlock()
+
+	for _, msg := range o.Pending() {
+		if ctx.Err() != nil {
+			break
+		}
+		o.attempt(ctx, &msg)
+	}
+	return len(o.Pending())
+}
+
+// Post the message once. It returns false and the time of the next
+// attempt if the message is not delivered and not dead. A post
+// interrupted by ctx is not counted as an attempt.
+func (o *Outbox) attempt(ctx context.Context, msg *Message) (time.Time, bool) {
+	o.Lock()
+	client, auth := o.Client, o.Auth
+	o.Unlock()
+
+	err := post(ctx, client, auth, msg)
+
+	o.Lock()
+	defer o.Unlock()
+
+	if err == nil {
+		os.Remove(o.path(msg.ID))
+		delete(o.msgs, msg.ID)
+		o.stats.Delivered++
+		return time.Time{}, true
+	}
+	if ctx.Err() != nil {
+		return msg.Next, false
+	}
+
+	o.stats.Failed++
+	msg.Attempts++
+	msg.Error = err.Error()
+	log.Println("Notify error:", msg.URL, msg.ID, "attempt", msg.Attempts, err)
+
+	if msg.Attempts >= o.MaxAttempts {
+		err = writeMessage(filepath.Join(o.dir, deadDir, msg.ID+msgExt), msg)
+		if err == nil {
+			os.Remove(o.path(msg.ID))
+			delete(o.msgs, msg.ID)
+			o.stats.Dead++
+			log.Println("Notify dead:", msg.URL, msg.ID)
+			return time.Time{}, true
+		}
+	}
+	msg.Next = time.Now().Add(o.backoff(msg.Attempts))
+	writeMessage(o.path(msg.ID), msg)
+	*o.msgs[msg.ID] = *msg
+	return msg.Next, false
+}
+
+func (o *Outbox) backoff(attempts int) time.Duration {
+	d := o.Backoff
+	for i := 1; i < attempts && d < o.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.MaxBackoff {
+		d = o.MaxBackoff
+	}
+	return d
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *Outbox) path(id string) string {
+	return filepath.Join(o.dir, id+msgExt)
+}
+
+func post(ctx context.Context, client *http.Client, auth *Auth, msg *Message) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", msg.URL, bytes.NewReader(msg.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if msg.Key != "" {
+		req.Header.Set(HeaderIdempotencyKey, msg.Key)
+	}
+	auth.Apply(req, msg.Body, time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func readDir(dir string) ([]Message, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+msgExt))
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]Message, 0, len(files))
+	for _, path := range files {
+		msg, err := readMessage(path)
+		if err != nil {
+			log.Println("Notify:", path, err)
+			continue
+		}
+		msgs = append(msgs, *msg)
+	}
+	sortMessages(msgs)
+	return msgs, nil
+}
+
+func readMessage(path string) (*Message, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(Message)
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+	if msg.ID+msgExt != filepath.Base(path) {
+		return nil, errors.New("Wrong message ID " + msg.ID)
+	}
+	return msg, nil
+}
+
+func writeMessage(path string, msg *Message) error {
+	b, err := json.MarshalIndent(msg, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := strings.TrimSuffix(path, msgExt) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func sortMessages(msgs []Message) {
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Created.Before(msgs[j].Created)
+	})
+}
@@ -0,0 +1,145 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	var calls, fail int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var m map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m["sha1"] != "abc" {
+			t.Errorf("Wrong body: %v %v", m, err)
+		}
+		if atomic.AddInt32(&fail, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	o, err := NewOutbox(dir)
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	o.MaxAttempts = 3
+	o.Backoff = time.Millisecond
+	o.MaxBackoff = 4 * time.Millisecond
+
+	// delivered after 2 failures
+	fail = 2
+	o.Send(srv.URL, "", map[string]string{"sha1": "abc"})
+	deliverAll(o)
+	if calls != 3 || len(o.Pending()) != 0 {
+		t.Errorf("Calls = %d, pending = %d, expected 3 and 0", calls, len(o.Pending()))
+	}
+
+	// dead after 3 failures
+	calls, fail = 0, 100
+	o.Send(srv.URL, "", map[string]string{"sha1": "abc"})
+
+	// the message survives a restart
+	o, _ = NewOutbox(dir)
+	o.MaxAttempts = 3
+	o.Backoff = time.Millisecond
+	o.MaxBackoff = 4 * time.Millisecond
+	if len(o.Pending()) != 1 {
+		t.Fatalf("Pending after reopen = %d, expected 1", len(o.Pending()))
+	}
+
+	deliverAll(o)
+	dead, _ := o.Dead()
+	if calls != 3 || len(dead) != 1 || dead[0].Attempts != 3 {
+		t.Fatalf("Calls = %d, dead = %+v, expected 3 calls and 1 dead message", calls, dead)
+	}
+
+	// replay
+	fail = 0
+	if err := o.Replay(dead[0].ID); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if err := o.Replay(dead[0].ID); err != ErrNotFound {
+		t.Errorf("Replay again = %v, expected %v", err, ErrNotFound)
+	}
+	deliverAll(o)
+	dead, _ = o.Dead()
+	if len(dead) != 0 || len(o.Pending()) != 0 {
+		t.Errorf("Dead = %d, pending = %d after replay, expected 0", len(dead), len(o.Pending()))
+	}
+	if st := o.Stats(); st != (Stats{Delivered: 1, Failed: 3, Dead: 1}) {
+		t.Errorf("Stats = %+v, expected 1 delivered, 3 failed, 1 dead", st)
+	}
+}
+
+func deliverAll(o *Outbox) {
+	for i := 0; i < 100 && len(o.Pending()) > 0; i++ {
+		o.deliver(time.Now())
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer srv.Close()
+
+	o, err := NewOutbox(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	o.Send(srv.URL, "a", map[string]string{"sha1": "abc"})
+	o.Send(srv.URL, "b", map[string]string{"sha1": "def"})
+
+	// the backoff is ignored
+	o.Lock()
+	for _, msg := range o.msgs {
+		msg.Next = time.Now().Add(time.Hour)
+	}
+	o.Unlock()
+
+	if n := o.Flush(context.Background()); n != 0 || calls != 2 {
+		t.Errorf("Flush = %d undelivered, %d calls, expected 0 and 2", n, calls)
+	}
+
+	o.Send(srv.URL, "c", map[string]string{"sha1": "abc"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n := o.Flush(ctx); n != 1 {
+		t.Errorf("Flush with done context = %d undelivered, expected 1", n)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stop
+	}))
+	defer srv.Close()
+	defer close(stop)
+
+	o, err := NewOutbox(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	o.MaxAttempts = 1
+	o.Send(srv.URL, "a", map[string]string{"sha1": "abc"})
+
+	// the interrupted post is not an attempt
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if n := o.Flush(ctx); n != 1 {
+		t.Errorf("Flush on timeout = %d undelivered, expected 1", n)
+	}
+	if p := o.Pending(); len(p) != 1 || p[0].Attempts != 0 || o.Stats().Failed != 0 {
+		t.Errorf("Pending = %+v, stats = %+v, expected 1 message without attempts", p, o.Stats())
+	}
+}
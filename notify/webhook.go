@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Types of events
+const (
+	EventFileAdded     = "file.added"
+	EventFileChanged   = "file.changed"
+	EventFileRemoved   = "file.removed"
+	EventIndexReloaded = "index.reloaded"
+)
+
+type (
+	Event struct {
+		Type    string    `json:"type"`
+		Time    time.Time `json:"time"`
+		Path    string    `json:"path,omitempty"`
+		Sha1    string    `json:"sha1,omitempty"`
+		Size    int64     `json:"size,omitempty"`
+		Mtime   int64     `json:"mtime,omitempty"`
+		Storage string    `json:"storage,omitempty"`
+
+		// index.reloaded
+		Records int `json:"records,omitempty"`
+		Added   int `json:"added,omitempty"`   // added replicas
+		Removed int `json:"removed,omitempty"` // removed replicas
+	}
+
+	// Webhook subscribes URL to Events. No Events means all events.
+	Webhook struct {
+		URL    string   `toml:"url"`
+		Events []string `toml:"events"`
+	}
+
+	// Webhooks publishes events to subscribers through the outbox
+	Webhooks struct {
+		Hooks  []Webhook
+		Outbox *Outbox
+	}
+)
+
+var (
+	ErrNoURL      = errors.New("URL is required")
+	ErrWrongEvent = errors.New("Unknown event")
+)
+
+func ValidEvent(event string) bool {
+	switch event {
+	case EventFileAdded, EventFileChanged, EventFileRemoved, EventIndexReloaded:
+		return true
+	}
+	return false
+}
+
+func (w *Webhook) Validate() error {
+	if w.URL == "" {
+		return ErrNoURL
+	}
+	for _, e := range w.Events {
+		if !ValidEvent(e) {
+			return ErrWrongEvent
+		}
+	}
+	return nil
+}
+
+func (w *Webhook) Match(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Key to recognize duplicates of the event
+func (e *Event) Key() string {
+	if e.Type == EventIndexReloaded {
+		return e.Type + ":" + strconv.FormatInt(e.Time.UnixNano(), 10)
+	}
+	return e.Type + ":" + e.Sha1 + ":" + strconv.FormatInt(e.Mtime, 10) + ":" + e.Path
+}
+
+// Publish the event to matching webhooks. The nil Webhooks does nothing.
+func (w *Webhooks) Publish(e Event) {
+	if w == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for i := range w.Hooks {
+		if w.Hooks[i].Match(e.Type) {
+			if err := w.Outbox.Send(w.Hooks[i].URL, e.Key(), e); err != nil {
+				log.Println("Webhook:", w.Hooks[i].URL, err)
+			}
+		}
+	}
+}
+
+// Enabled reports whether any webhook is subscribed to the event
+func (w *Webhooks) Enabled(event string) bool {
+	if w == nil {
+		return false
+	}
+	for i := range w.Hooks {
+		if w.Hooks[i].Match(event) {
+			return true
+		}
+	}
+	return false
+}
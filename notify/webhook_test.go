@@ -0,0 +1,60 @@
+package notify
+
+import (
+	"testing"
+)
+
+func TestWebhooks(t *testing.T) {
+	o, err := NewOutbox(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewOutbox: %v", err)
+	}
+	w := &Webhooks{
+		Hooks: []Webhook{
+			{URL: "http://a", Events: []string{EventFileAdded, EventFileRemoved}},
+			{URL: "http://b"},
+		},
+		Outbox: o,
+	}
+
+	w.Publish(Event{Type: EventFileAdded, Sha1: "abc"})
+	w.Publish(Event{Type: EventIndexReloaded})
+
+	msgs := o.Pending()
+	if len(msgs) != 3 {
+		t.Fatalf("Messages = %d, expected 3", len(msgs))
+	}
+	urls := map[string]int{}
+	for _, msg := range msgs {
+		urls[msg.URL]++
+	}
+	if urls["http://a"] != 1 || urls["http://b"] != 2 {
+		t.Errorf("Messages by URL = %v, expected a:1 b:2", urls)
+	}
+
+	if !w.Enabled(EventFileChanged) {
+		t.Errorf("Enabled %s = false, expected true", EventFileChanged)
+	}
+	var none *Webhooks
+	none.Publish(Event{Type: EventFileAdded})
+	if none.Enabled(EventFileAdded) {
+		t.Errorf("Enabled of nil webhooks = true")
+	}
+}
+
+func TestWebhookValidate(t *testing.T) {
+	tests := []struct {
+		hook Webhook
+		err  error
+	}{
+		{Webhook{URL: "http://a"}, nil},
+		{Webhook{URL: "http://a", Events: []string{EventFileAdded, EventIndexReloaded}}, nil},
+		{Webhook{Events: []string{EventFileAdded}}, ErrNoURL},
+		{Webhook{URL: "http://a", Events: []string{"file.moved"}}, ErrWrongEvent},
+	}
+	for _, tt := range tests {
+		if err := tt.hook.Validate(); err != tt.err {
+			t.Errorf("Validate %+v = %v, expected %v", tt.hook, err, tt.err)
+		}
+	}
+}
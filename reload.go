@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/Bnei-Baruch/filer-backend/fileutils"
+	"github.com/Bnei-Baruch/filer-backend/notify"
+	"github.com/Bnei-Baruch/filer-backend/transcode"
+)
+
+// Summary of changed settings
+type changes []string
+
+func (ch *changes) add(name string, old, new interface{}) {
+	if !reflect.DeepEqual(old, new) {
+		*ch = append(*ch, fmt.Sprintf("%s: %v -> %v", name, old, new))
+	}
+}
+
+// The values are not logged: keys, tokens, tables
+func (ch *changes) addChanged(name string, old, new interface{}) {
+	if !reflect.DeepEqual(old, new) {
+		*ch = append(*ch, name+": changed")
+	}
+}
+
+// Reread the config and apply the settings which are safe to change live.
+// Other changed settings are logged to be applied by a restart.
+func reload(tr transcode.Transcoder, outbox *notify.Outbox, lw *fileutils.LogWriter, updReload chan time.Duration) {
+	config, err := configLoad("")
+	if err != nil {
+		log.Println("Reload (config is not changed):", err)
+		return
+	}
+	c, err := parseConfig(config)
+	if err != nil {
+		log.Println("Reload (config is not changed):", err)
+		return
+	}
+
+	var applied, restart changes
+	cur := *getconf()
+	next := cur
+
+	applied.add("server.getfileexpire", cur.GetFileExpire, c.Server.GetFileExpire)
+	applied.add("server.verifydownload", cur.VerifyDownload, c.Server.VerifyDownload)
+	applied.addChanged("server.signing", cur.Signing, c.Server.Signing)
+	applied.add("server.baseurl", cur.BaseURL, c.Server.BaseURL)
+	next.GetFileExpire = c.Server.GetFileExpire
+	next.VerifyDownload = c.Server.VerifyDownload
+	next.Signing = c.Server.Signing
+	next.BaseURL = c.Server.BaseURL
+
+	// not set if transcoding is disabled, that is applied by a restart
+	if c.Transcoder.Concurrency > 0 {
+		applied.add("transcoder.tolerance", cur.TransTolerance, c.Server.TransTolerance)
+		next.TransTolerance = c.Server.TransTolerance
+	}
+
+	// without an outbox of the start the notifications are not retried
+	if outbox != nil {
+		applied.add("mdbapp.api", cur.TransNotify, c.Server.TransNotify)
+		next.TransNotify = c.Server.TransNotify
+	} else {
+		restart.add("mdbapp.api", cur.TransNotify, c.Server.TransNotify)
+	}
+	applied.add("mdbapp.station", cur.NotifyStation, c.Server.NotifyStation)
+	applied.add("mdbapp.user", cur.NotifyUser, c.Server.NotifyUser)
+	applied.addChanged("mdbapp.token/secret", cur.NotifyAuth, c.Server.NotifyAuth)
+	applied.add("mdbapp.timeout", cur.NotifyTimeout, c.Server.NotifyTimeout)
+	applied.add("mdbapp.attempts", cur.NotifyAttempts, c.Server.NotifyAttempts)
+	applied.add("mdbapp.backoff", cur.NotifyBackoff, c.Server.NotifyBackoff)
+	next.NotifyStation = c.Server.NotifyStation
+	next.NotifyUser = c.Server.NotifyUser
+	next.NotifyAuth = c.Server.NotifyAuth
+	next.NotifyTimeout = c.Server.NotifyTimeout
+	next.NotifyAttempts = c.Server.NotifyAttempts
+	next.NotifyBackoff = c.Server.NotifyBackoff
+	if outbox != nil {
+		outbox.Configure(next.NotifyAuth, next.NotifyTimeout, next.NotifyAttempts, next.NotifyBackoff)
+	}
+
+	// the rest of the server settings are used at the start
+	restart.add("server.listen", cur.Listen, c.Server.Listen)
+	restart.add("server.stoponupdate", cur.StopOnUpdate, c.Server.StopOnUpdate)
+	restart.add("server.shutdowntimeout", cur.ShutdownTimeout, c.Server.ShutdownTimeout)
+	restart.add("server.upgradetimeout", cur.UpgradeTimeout, c.Server.UpgradeTimeout)
+	restart.add("mdbapp.outbox", cur.NotifyOutbox, c.Server.NotifyOutbox)
+	restart.add("server.basepath", []string{cur.BasePathArchive, cur.BasePathOriginal}, []string{c.Server.BasePathArchive, c.Server.BasePathOriginal})
+	restart.add("server.transdest", cur.TransDest, c.Server.TransDest)
+	restart.add("server.transwork", cur.TransWork, c.Server.TransWork)
+	restart.add("server.trustedproxies", cur.TrustedProxies, c.Server.TrustedProxies)
+	restart.add("remote.mode", cur.RemoteMode, c.Server.RemoteMode)
+	restart.addChanged("remote.locations", cur.Remote, c.Server.Remote)
+	restart.addChanged("auth.keys", cur.APIKeys, c.Server.APIKeys)
+	restart.addChanged("cors", cur.CORS, c.Server.CORS)
+	restart.addChanged("transcoder.presets", conf.Transcoder.Presets, c.Transcoder.Presets)
+	restart.add("transcoder.reserve", conf.Transcoder.Reserve, c.Transcoder.Reserve)
+	restart.add("transcoder.keepjobs", conf.Transcoder.KeepJobs, c.Transcoder.KeepJobs)
+	restart.add("transcoder.stoptimeout", conf.Transcoder.StopTimeout, c.Transcoder.StopTimeout)
+	restart.add("index", conf.Index, c.Index)
+	restart.addChanged("events", conf.Events, c.Events)
+	restart.add("update.basedir", conf.Update.BaseDir, c.Update.BaseDir)
+	restart.add("location", conf.Location, c.Location)
+
+	// transcoding is enabled or disabled by a restart
+	if (conf.Transcoder.Concurrency > 0) == (c.Transcoder.Concurrency > 0) {
+		applied.add("transcoder.concurrency", conf.Transcoder.Concurrency, c.Transcoder.Concurrency)
+		if conf.Transcoder.Concurrency != c.Transcoder.Concurrency {
+			tr.Resize(c.Transcoder.Concurrency)
+			conf.Transcoder.Concurrency = c.Transcoder.Concurrency
+		}
+	} else {
+		restart.add("transcoder.concurrency", conf.Transcoder.Concurrency, c.Transcoder.Concurrency)
+	}
+
+	if c.Update.Reload > 0 && c.Update.Reload != conf.Update.Reload {
+		applied.add("update.reload", conf.Update.Reload, c.Update.Reload)
+		// the update server may be busy hashing, keep only the latest value
+		select {
+		case <-updReload:
+		default:
+		}
+		updReload <- c.Update.Reload
+		conf.Update.Reload = c.Update.Reload
+	}
+
+	// reopened anyway, e.g. after rotation
+	applied.add("server.log", lw.Path(), c.Log)
+	if err := lw.Reopen(c.Log); err != nil {
+		log.Println("Reload:", c.Log, err)
+	}
+
+	setconf(&next)
+
+	if len(applied) == 0 {
+		log.Println("Reload: no changes")
+	}
+	for _, s := range applied {
+		log.Println("Reload:", s)
+	}
+	for _, s := range restart {
+		log.Println("Reload (restart to apply):", s)
+	}
+}
@@ -4,165 +4,254 @@ import (
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
+	"github.com/Bnei-Baruch/filer-backend/apikey"
 	"github.com/Bnei-Baruch/filer-backend/fileindex"
 	"github.com/Bnei-Baruch/filer-backend/fileutils"
+	"github.com/Bnei-Baruch/filer-backend/notify"
+	"github.com/Bnei-Baruch/filer-backend/signing"
 	"github.com/Bnei-Baruch/filer-backend/transcode"
 
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 )
 
 var (
-	fileMap sync.Map
-	srvCtx  ServerCtx
-
-	preset0 string = "-c:v libx264 -profile:v main -preset fast -b:v %dk %s -c:a libfdk_aac -b:a %dk"
-)
-
-func preset(probe *transcode.FFprobe) string {
-	audio, video := streams(probe)
-	if audio == nil || video == nil {
-		return ""
-	}
-
-	abitrate := 64
-	if audio.Channels == 1 {
-		if audio.BitRate < 40000 {
-			abitrate = 32
-		} else if audio.BitRate < 62000 {
-			abitrate = 48
-		}
-	} else {
-		if audio.BitRate > 90000 {
-			abitrate = 96
-		}
-	}
-
-	vbitrate := 256
-	vr := video.BitRate
-	if vr == 0 {
-		vr = probe.Format.BitRate - audio.BitRate
-	}
-	if vr < 180000 {
-		vbitrate = 128
-	} else if vr > 600000 {
-		vbitrate = 512
-	} else if vr > 400000 {
-		vbitrate = 384
-	}
-
-	vsync := ""
-	if video.FrameRate == "1000/1" {
-		vsync = "-vsync vfr"
+	srvCtx ServerCtx
+
+	// CORS policies by the path prefix, the longest prefix first
+	corsGroups = []struct {
+		Name   string
+		Prefix string
+	}{
+		{"admin", "/api/v1/admin/"},
+		{"api", "/api/"},
+		{"files", "/"},
 	}
+)
 
-	return fmt.Sprintf(preset0, vbitrate, vsync, abitrate)
+func getfs() *fileindex.FastSearch {
+	return srvCtx.Index.GetFS()
 }
 
-func streams(probe *transcode.FFprobe) (audio *transcode.FFstream, video *transcode.FFstream) {
-	if len(probe.Streams) != 2 {
-		return nil, nil
-	}
-
-	if probe.Streams[0].Type == "audio" && probe.Streams[1].Type == "video" {
-		return probe.Streams[0], probe.Streams[1]
-	}
+func search(sha1 string) (fileindex.FileList, bool) {
+	return srvCtx.Index.GetFS().Search(sha1)
+}
 
-	if probe.Streams[1].Type == "audio" && probe.Streams[0].Type == "video" {
-		return probe.Streams[1], probe.Streams[0]
+// Find the most preferred replica of the file available on this machine
+func replica(sha1 string) (*fileindex.FileRec, bool) {
+	if fl, ok := search(sha1); ok {
+		return fileindex.Choose(srvCtx.Replicas, fl, fileindex.VerifyLocal)
 	}
+	return nil, false
+}
 
-	return nil, nil
+func setfs(fs *fileindex.FastSearch) {
+	srvCtx.Index.SetFS(fs)
 }
 
-func getfs() *fileindex.FastSearch {
-	return srvCtx.Index.GetFS()
+// The server config is replaced as a whole on reload
+func getconf() *ServerConf {
+	p := unsafe.Pointer(&srvCtx.Config)
+	return (*ServerConf)(atomic.LoadPointer((*unsafe.Pointer)(p)))
 }
 
-func search(sha1 string) (fileindex.FileList, bool) {
-	return srvCtx.Index.GetFS().Search(sha1)
+func setconf(c *ServerConf) {
+	p := unsafe.Pointer(&srvCtx.Config)
+	atomic.StorePointer((*unsafe.Pointer)(p), unsafe.Pointer(c))
 }
 
-func setfs(fs *fileindex.FastSearch) {
-	srvCtx.Index.SetFS(fs)
+func storageID(fr *fileindex.FileRec) string {
+	if fr.Device == nil {
+		return "unknown"
+	}
+	return fr.Device.Id
 }
 
 func getHello(c echo.Context) error {
-	c.Response().Header().Set(echo.HeaderAccessControlAllowOrigin, "*")
 	return c.String(http.StatusOK, "Hello, World!\n")
 }
 
 // GET /get/:sha1/:name
 func getFile(c echo.Context) error {
-	c.Response().Header().Set(echo.HeaderAccessControlAllowOrigin, "*")
+	cfg := getconf()
 
 	sha1sum := c.Param("sha1")
-	if srvCtx.Config.VerifyDownload {
-		name := c.Param("name")
-		key := sha1sum + "/" + name
-		if reqtime, ok := fileMap.Load(key); ok {
-			if time.Since(reqtime.(time.Time)) < srvCtx.Config.GetFileExpire {
-				if fl, ok := search(sha1sum); ok {
-					c.Response().Header().Set(echo.HeaderContentDisposition, "attachment")
-					return c.File(fl[0].Path)
+	name := c.Param("name")
+	// echo routes the escaped path if it has encoded characters, e.g. %2C
+	if c.Request().URL.RawPath != "" {
+		var err error
+		if name, err = url.PathUnescape(name); err != nil {
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+	if cfg.VerifyDownload {
+		client, err := cfg.Signing.Verify(sha1sum, name, c.QueryParams(), time.Now())
+		if err != nil {
+			return c.NoContent(http.StatusForbidden)
+		}
+		if client != "" && !signing.MatchClient(client, c.RealIP()) {
+			log.Println("Download denied:", sha1sum, name, "client:", c.RealIP(), "registered:", client)
+			return c.NoContent(http.StatusForbidden)
+		}
+	}
+	if fr, ok := replica(sha1sum); ok {
+		defer observeDownload(c, storageID(fr))
+		return serveFile(c, fr.Path, sha1sum, name)
+	}
+	if fr, rawurl, ok := remoteReplica(sha1sum, name); ok {
+		// the remote filer verifies the signature too
+		if q := c.QueryString(); q != "" {
+			rawurl += "?" + q
+		}
+		if cfg.RemoteMode == "redirect" {
+			return c.Redirect(http.StatusFound, rawurl)
+		}
+		defer observeDownload(c, storageID(fr))
+		return proxyFile(c, rawurl, sha1sum, name)
+	}
+	return c.NoContent(http.StatusNotFound)
+}
+
+// X-Forwarded-For is honored only from the trusted proxies
+func ipExtractor(proxies []*net.IPNet) echo.IPExtractor {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, ipnet := range proxies {
+		opts = append(opts, echo.TrustIPRange(ipnet))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
+
+// Requests must have an API key with the scope. No keys - no authentication.
+func requireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			keys := getconf().APIKeys
+			if !keys.Enabled() {
+				return next(c)
+			}
+			key, err := keys.Authorize(c.Request(), scope)
+			if err != nil {
+				log.Println("API denied:", c.RealIP(), c.Request().Method, c.Path(), err)
+				if key == nil {
+					c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+					return c.String(http.StatusUnauthorized, err.Error())
 				}
+				return c.String(http.StatusForbidden, err.Error())
 			}
+			c.Set("apikey", key.Name)
+			return next(c)
 		}
-	} else {
-		if fl, ok := search(sha1sum); ok {
-			c.Response().Header().Set(echo.HeaderContentDisposition, "attachment")
-			return c.File(fl[0].Path)
+	}
+}
+
+// One CORS middleware for all routes, the policy is chosen by the route group.
+// Preflight requests are answered with the methods of the route.
+func corsPolicy(policies CORSPolicy) echo.MiddlewareFunc {
+	mws := make([]echo.MiddlewareFunc, len(corsGroups))
+	for i, g := range corsGroups {
+		if cfg, ok := policies[g.Name]; ok {
+			mws[i] = middleware.CORSWithConfig(cfg)
+		}
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		handlers := make([]echo.HandlerFunc, len(mws))
+		for i, mw := range mws {
+			if mw != nil {
+				handlers[i] = mw(next)
+			} else {
+				handlers[i] = next
+			}
+		}
+		return func(c echo.Context) error {
+			path := c.Request().URL.Path
+			for i, g := range corsGroups {
+				if strings.HasPrefix(path, g.Prefix) {
+					return handlers[i](c)
+				}
+			}
+			return next(c)
 		}
 	}
-	return c.NoContent(http.StatusNotFound)
 }
 
-func webServer(ctx ServerCtx) {
+func webServer(ctx ServerCtx) *echo.Echo {
 	srvCtx = ctx
 
 	e := echo.New()
 	e.HideBanner = true
+	e.IPExtractor = ipExtractor(ctx.Config.TrustedProxies)
+	e.Use(corsPolicy(ctx.Config.CORS))
+	if !ctx.Config.APIKeys.Enabled() {
+		log.Println("API: no keys in auth.keys, authentication is disabled")
+	}
 
 	e.GET("/", getHello)
+	e.GET("/healthz", getHealth)
+	e.GET("/readyz", getReady)
+	e.GET("/metrics", getMetrics())
 	e.GET("/get/:sha1/:name", getFile)
 	e.HEAD("/get/:sha1/:name", getFile)
 
 	e.GET("/api/v1/catalog", getCatalog)
-	e.POST("/api/v1/get", postRegFile)
+	e.POST("/api/v1/get", postRegFile, requireScope(apikey.ScopeDownload))
 	e.GET("/api/v1/storages", getStorages)
-	e.POST("/api/v1/showformat", postShowFormat)
-	e.POST("/api/v1/transcode", postTranscode)
+	e.POST("/api/v1/showformat", postShowFormat, requireScope(apikey.ScopeTranscode))
+	e.POST("/api/v1/transcode", postTranscode, requireScope(apikey.ScopeTranscode))
+	e.GET("/api/v1/transcode/presets", getPresets)
+	e.GET("/api/v1/transcode/status", getTransStatus)
+	e.GET("/api/v1/transcode/:id", getTranscode)
+	e.DELETE("/api/v1/transcode/:id", deleteTranscode, requireScope(apikey.ScopeTranscode))
+	e.PATCH("/api/v1/transcode/:id", patchTranscode, requireScope(apikey.ScopeTranscode))
 	e.GET("/api/v1/transqlen", getTransQLen)
-	e.POST("/api/v1/update", postUpdate)
+	e.POST("/api/v1/update", postUpdate, requireScope(apikey.ScopeUpdate))
 
-	e.Logger.Fatal(e.Start(srvCtx.Config.Listen))
+	admin := e.Group("/api/v1/admin", requireScope(apikey.ScopeAdmin))
+	admin.GET("/notify", getNotifyDead)
+	admin.POST("/notify/replay", postNotifyReplay)
+
+	return e
 }
 
 func pathTranslate(path string) string {
+	cfg := getconf()
+
 	path = strings.Replace(path, "\\", "/", -1)
 	if x := strings.Index(path, "/Archive/"); x >= 0 {
-		path = srvCtx.Config.BasePathArchive + path[x:]
+		path = cfg.BasePathArchive + path[x:]
 	} else if x := strings.Index(path, "/Archive_PN/"); x >= 0 {
-		path = srvCtx.Config.BasePathArchive + path[x:]
+		path = cfg.BasePathArchive + path[x:]
 	} else if x := strings.Index(path, "/__BACKUP/"); x >= 0 {
-		path = srvCtx.Config.BasePathOriginal + path[x:]
+		path = cfg.BasePathOriginal + path[x:]
 	}
 	return path
 }
 
 func updateServer(ctx UpdateCtx) {
-	tick := time.Tick(ctx.Config.Reload)
+	ticker := time.NewTicker(ctx.Config.Reload)
 	for {
 		select {
-		case <-tick:
+		case d := <-ctx.Reload:
+			ticker.Reset(d)
+		case <-ticker.C:
 			if ctx.Index.IsModified() {
 				ctx.Index.Load()
 			}
@@ -195,11 +284,13 @@ func updateServer(ctx UpdateCtx) {
 					continue
 				}
 
-				sha1, _, stat2, err := fileutils.SHA1_File(pathtr)
+				start := time.Now()
+				sha1, n, stat2, err := fileutils.SHA1_File(pathtr)
 				if err != nil {
 					log.Println(err)
 					continue
 				}
+				observeHash(start, n)
 
 				// Verify that the file has not been modified during a checksum creation
 				if stat2.Size() != stat.Size() || stat2.ModTime() != stat.ModTime() {
@@ -207,13 +298,11 @@ func updateServer(ctx UpdateCtx) {
 					continue
 				}
 
-				// Add a record to index (non persistent)
+				// Add a record to index (persistent with journal)
 				fr.Sha1 = hex.EncodeToString(sha1)
 				log.Println("SHA1:", fr.Sha1)
 
-				fsdup := fs.Duplicate()
-				fsdup.Update(fr)
-				setfs(fsdup)
+				ctx.Index.Update(fr)
 			} else {
 				log.Println(err)
 			}
@@ -221,16 +310,33 @@ func updateServer(ctx UpdateCtx) {
 	}
 }
 
+// Handle results until the transcoder is stopped
 func transcodeResult(tr transcode.Transcoder) {
 	for {
-		r := tr.Result()
-		if r.Err == nil {
-			handleResult(r.Task)
+		r, ok := tr.Result()
+		if !ok {
+			return
+		}
+		if r.Err == transcode.ErrCanceled {
+			cancelJob(srvCtx.Jobs, r.Task.ID)
+			observeTranscode(&r, transcode.JobCanceled)
+			log.Println("Transcode (canceled):", r.Task.Source)
+		} else if r.Err == nil {
+			sum, err := handleResult(r.Task)
+			if err != nil {
+				finishJob(srvCtx.Jobs, r.Task.ID, "", err.Error())
+				observeTranscode(&r, transcode.JobFailed)
+			} else {
+				finishJob(srvCtx.Jobs, r.Task.ID, sum, "")
+				observeTranscode(&r, transcode.JobDone)
+			}
 		} else {
+			observeTranscode(&r, transcode.JobFailed)
 			req, ok := r.Task.Ctx.(*TranscodeReq)
 			if ok {
-				sendError(req.SHA1, string(r.Out))
+				sendError(r.Task.ID, req.SHA1, string(r.Out))
 			}
+			finishJob(srvCtx.Jobs, r.Task.ID, "", r.Err.Error()+"\n"+string(r.Out))
 
 			log.Println("Transcode:", r.Task.Source)
 			log.Println("To:", r.Task.Target)
@@ -241,83 +347,195 @@ func transcodeResult(tr transcode.Transcoder) {
 	}
 }
 
-func handleResult(t transcode.TranscodeTask) {
+// Queue again the jobs interrupted by a restart
+func transcodeResume(tr transcode.Transcoder, jobs *transcode.JobStore) {
+	for _, job := range jobs.Pending() {
+		if job.State == transcode.JobRunning {
+			os.Remove(job.Target)
+			jobs.Update(job.ID, func(job *transcode.Job) {
+				job.State = transcode.JobQueued
+				job.Started = nil
+			})
+		}
+
+		task := transcode.TranscodeTask{
+			ID:       job.ID,
+			Ctx:      &TranscodeReq{SHA1: job.SHA1, Preset: job.Preset, Priority: job.Priority},
+			Duration: job.Duration,
+			Estimate: job.Estimate,
+			Preset:   job.Args,
+			Priority: job.Priority,
+			Source:   job.Source,
+			Target:   job.Target,
+		}
+		if !tr.Transcode(task) {
+			finishJob(jobs, job.ID, "", "Queue is full")
+			continue
+		}
+		log.Println("Transcode (resumed):", job.ID, job.Source)
+	}
+}
+
+// Set the final state of a job. The job is failed if msg is not empty.
+func finishJob(jobs *transcode.JobStore, id, sha1 string, msg string) {
+	if jobs == nil || id == "" {
+		return
+	}
+	now := time.Now()
+	err := jobs.Update(id, func(job *transcode.Job) {
+		job.Finished = &now
+		job.TargetSHA1 = sha1
+		job.Error = msg
+		if msg == "" {
+			job.State = transcode.JobDone
+		} else {
+			job.State = transcode.JobFailed
+		}
+	})
+	if err != nil {
+		log.Println("Transcode job:", id, err)
+	}
+}
+
+func cancelJob(jobs *transcode.JobStore, id string) {
+	if jobs == nil || id == "" {
+		return
+	}
+	now := time.Now()
+	err := jobs.Update(id, func(job *transcode.Job) {
+		job.Finished = &now
+		job.State = transcode.JobCanceled
+	})
+	if err != nil {
+		log.Println("Transcode job:", id, err)
+	}
+}
+
+// Hash and publish the transcoded file. It returns SHA1 of the file.
+func handleResult(t transcode.TranscodeTask) (string, error) {
+	cfg := getconf()
+
 	req, ok := t.Ctx.(*TranscodeReq)
 	if !ok {
 		log.Println("Wrong transcoding result")
-		return
+		return "", errors.New("Wrong transcoding result")
+	}
+	p, ok := srvCtx.Presets[req.PresetName()]
+	if !ok {
+		p = &transcode.Preset{}
+	}
+
+	// verify the output, ffmpeg may exit normally with a truncated file
+	err, probe := transcode.Probe(t.Target)
+	if err == nil {
+		err = transcode.VerifyOutput(probe, t.Duration, cfg.TransTolerance, p.IsAudio())
+	}
+	if err != nil {
+		log.Println("Transcode (verify):", t.Source, err)
+		sendError(t.ID, req.SHA1, err.Error())
+		return "", err
 	}
 
 	sum, size, stat, err := fileutils.SHA1_File(t.Target)
 	if err != nil {
-		sendError(req.SHA1, err.Error())
+		sendError(t.ID, req.SHA1, err.Error())
 		log.Println(err)
-		return
+		return "", err
 	}
 
+	// the output extension and the suffix of the name follow the format
+	ext := path.Ext(t.Target)
+	suffix := p.Suffix
+
 	// finalize the name of the transcoded file in the working folder
-	tgtPath := path.Dir(t.Target) + "/" + req.SHA1 + "_" + hex.EncodeToString(sum) + ".mp4"
+	tgtPath := path.Dir(t.Target) + "/" + req.SHA1 + "_" + hex.EncodeToString(sum) + ext
 	err = os.Rename(t.Target, tgtPath)
 	if err != nil {
 		log.Println(err)
-		sendError(req.SHA1, err.Error())
-		return
+		sendError(t.ID, req.SHA1, err.Error())
+		return "", err
 	}
 
 	// make a hard link from the working folder to the destination folder
 	srcBase := path.Base(t.Source)
-	destBase := srcBase[0:len(srcBase)-len(path.Ext(srcBase))] + ".mp4"
-	destPath := srvCtx.Config.TransDest + destBase
+	destBase := srcBase[0:len(srcBase)-len(path.Ext(srcBase))] + suffix + ext
+	destPath := cfg.TransDest + destBase
 
 	os.Remove(destPath)
 	err = os.Link(tgtPath, destPath)
 	if err != nil {
 		log.Println(err)
-		sendError(req.SHA1, err.Error())
-		return
+		sendError(t.ID, req.SHA1, err.Error())
+		return "", err
 	}
 
 	// send update notify to indexer
 	srvCtx.Update <- destPath
 
 	// send the transcoding result to MDB application
-	if len(srvCtx.Config.TransNotify) > 0 {
+	if len(cfg.TransNotify) > 0 {
+		key := t.ID + ":" + hex.EncodeToString(sum)
 		m := map[string]interface{}{
-			"original_sha1": req.SHA1,
-			"sha1":          hex.EncodeToString(sum),
-			"file_name":     destBase,
-			"size":          size,
-			"created_at":    stat.ModTime().Unix(),
-			"station":       srvCtx.Config.NotifyStation,
-			"user":          srvCtx.Config.NotifyUser,
+			"original_sha1":   req.SHA1,
+			"sha1":            hex.EncodeToString(sum),
+			"file_name":       destBase,
+			"size":            size,
+			"created_at":      stat.ModTime().Unix(),
+			"station":         cfg.NotifyStation,
+			"user":            cfg.NotifyUser,
+			"idempotency_key": key,
 		}
-		sendNotify(srvCtx.Config.TransNotify, m)
+		sendNotify(cfg.TransNotify, key, m)
 	}
+	return hex.EncodeToString(sum), nil
 }
 
-func sendError(sha1 string, msg string) {
+// Send an error of the job to MDB application
+func sendError(id, sha1 string, msg string) {
+	cfg := getconf()
+	if len(cfg.TransNotify) == 0 {
+		return
+	}
+	key := id + ":error"
 	m := map[string]interface{}{
-		"original_sha1": sha1,
-		"message":       msg,
-		"station":       srvCtx.Config.NotifyStation,
-		"user":          srvCtx.Config.NotifyUser,
+		"original_sha1":   sha1,
+		"message":         msg,
+		"station":         cfg.NotifyStation,
+		"user":            cfg.NotifyUser,
+		"idempotency_key": key,
 	}
-	sendNotify(srvCtx.Config.TransNotify, m)
+	sendNotify(cfg.TransNotify, key, m)
 }
 
-func sendNotify(api string, m map[string]interface{}) {
+// Send a notification through the outbox with retries,
+// or once if there is no outbox
+func sendNotify(api, key string, m map[string]interface{}) {
+	cfg := getconf()
+
+	if srvCtx.Outbox != nil {
+		err := srvCtx.Outbox.Send(api, key, m)
+		if err == nil {
+			return
+		}
+		log.Println("Notify outbox:", err)
+	}
+
 	mJson, _ := json.Marshal(m)
 	contentReader := bytes.NewReader(mJson)
 	req, _ := http.NewRequest("POST", api, contentReader)
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	req.Header.Set(notify.HeaderIdempotencyKey, key)
+	cfg.NotifyAuth.Apply(req, mJson, time.Now())
+	client := &http.Client{Timeout: cfg.NotifyTimeout}
 	resp, err := client.Do(req)
 	if err == nil {
 		resp.Body.Close()
 		if resp.StatusCode != 200 {
+			err = errors.New(resp.Status)
 			log.Println("Notify error:", resp.StatusCode, m["file_name"])
 		}
 	} else {
 		log.Println(err)
 	}
+	observeNotify(err)
 }
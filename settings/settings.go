@@ -0,0 +1,291 @@
+package settings
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+type (
+	// Error is a problem of a setting
+	Error struct {
+		Key  string
+		Line int // 0 if the key is missing
+		Msg  string
+	}
+
+	// Errors are all problems of a config
+	Errors []Error
+
+	// Reader reads typed settings of a config with defaults.
+	// Wrong settings are collected as errors, the default is returned instead.
+	// The keys which have not been read are reported by Unknown.
+	Reader struct {
+		tree *toml.Tree
+		errs Errors
+		used map[string]bool // read keys, a table is read with all its keys
+	}
+)
+
+func (e Error) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Key, e.Msg)
+	}
+	return e.Key + ": " + e.Msg
+}
+
+func (errs Errors) Error() string {
+	ss := make([]string, len(errs))
+	for i, e := range errs {
+		ss[i] = e.Error()
+	}
+	return strings.Join(ss, "\n")
+}
+
+func NewReader(tree *toml.Tree) *Reader {
+	return &Reader{tree: tree, used: make(map[string]bool)}
+}
+
+// get the value of the key and mark it as read
+func (r *Reader) get(key string) interface{} {
+	r.used[key] = true
+	return r.tree.Get(key)
+}
+
+// Unknown reports the keys of the config which have not been read,
+// e.g. misspelled ones. It is called after reading all settings.
+func (r *Reader) Unknown() {
+	r.unknown(r.tree, "")
+}
+
+func (r *Reader) unknown(t *toml.Tree, prefix string) {
+	for _, name := range t.Keys() {
+		key := prefix + name
+		if r.used[key] {
+			continue
+		}
+		if sub, ok := t.GetPath([]string{name}).(*toml.Tree); ok {
+			r.unknown(sub, key+".")
+			continue
+		}
+		r.errs = append(r.errs, Error{Key: key, Line: t.GetPositionPath([]string{name}).Line, Msg: "unknown setting"})
+	}
+}
+
+// Err returns Errors in the order of lines, missing keys last, or nil
+func (r *Reader) Err() error {
+	if len(r.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(r.errs, func(i, j int) bool {
+		a, b := r.errs[i].Line, r.errs[j].Line
+		return a != 0 && (b == 0 || a < b)
+	})
+	return r.errs
+}
+
+// Errorf adds a problem of the key
+func (r *Reader) Errorf(key string, format string, args ...interface{}) {
+	r.errs = append(r.errs, Error{Key: key, Line: r.tree.GetPosition(key).Line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// ErrorAt adds a problem of a table of an array
+func (r *Reader) ErrorAt(key string, t *toml.Tree, format string, args ...interface{}) {
+	r.errs = append(r.errs, Error{Key: key, Line: t.Position().Line, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (r *Reader) Has(key string) bool {
+	return r.tree.Has(key)
+}
+
+func (r *Reader) typeError(key, expected string, v interface{}) {
+	if s, ok := v.(string); ok {
+		r.Errorf(key, "expected %s, got string %q", expected, s)
+	} else {
+		r.Errorf(key, "expected %s, got %T", expected, v)
+	}
+}
+
+// Required reports a missing key
+func (r *Reader) Required(key string) bool {
+	if r.tree.Has(key) {
+		return true
+	}
+	r.Errorf(key, "required")
+	return false
+}
+
+func (r *Reader) String(key, def string) string {
+	v := r.get(key)
+	if v == nil {
+		return def
+	}
+	s, ok := v.(string)
+	if !ok {
+		r.typeError(key, "string", v)
+		return def
+	}
+	return s
+}
+
+func (r *Reader) Bool(key string, def bool) bool {
+	v := r.get(key)
+	if v == nil {
+		return def
+	}
+	b, ok := v.(bool)
+	if !ok {
+		r.typeError(key, "true or false", v)
+		return def
+	}
+	return b
+}
+
+// Int in [min, max]
+func (r *Reader) Int(key string, def, min, max int64) int64 {
+	v := r.get(key)
+	if v == nil {
+		return def
+	}
+	n, ok := v.(int64)
+	if !ok {
+		r.typeError(key, "integer", v)
+		return def
+	}
+	if n < min || n > max {
+		r.Errorf(key, "%d is out of range [%d, %d]", n, min, max)
+		return def
+	}
+	return n
+}
+
+// Float in [min, max]. An integer is accepted.
+func (r *Reader) Float(key string, def, min, max float64) float64 {
+	v := r.get(key)
+	if v == nil {
+		return def
+	}
+	var f float64
+	switch x := v.(type) {
+	case float64:
+		f = x
+	case int64:
+		f = float64(x)
+	default:
+		r.typeError(key, "number", v)
+		return def
+	}
+	if f < min || f > max {
+		r.Errorf(key, "%g is out of range [%g, %g]", f, min, max)
+		return def
+	}
+	return f
+}
+
+// Seconds is a non-negative integer number of seconds
+func (r *Reader) Seconds(key string, def int64) time.Duration {
+	return time.Duration(r.Int(key, def, 0, 1<<32)) * time.Second
+}
+
+// Positive seconds
+func (r *Reader) Interval(key string, def int64) time.Duration {
+	return time.Duration(r.Int(key, def, 1, 1<<32)) * time.Second
+}
+
+func (r *Reader) Strings(key string, def []string) []string {
+	v := r.get(key)
+	if v == nil {
+		return def
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		r.typeError(key, "array of strings", v)
+		return def
+	}
+	ss := make([]string, 0, len(list))
+	for _, x := range list {
+		s, ok := x.(string)
+		if !ok {
+			r.typeError(key, "array of strings", x)
+			return def
+		}
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+// Table or nil if it is missing
+func (r *Reader) Table(key string) *toml.Tree {
+	v := r.get(key)
+	if v == nil {
+		return nil
+	}
+	t, ok := v.(*toml.Tree)
+	if !ok {
+		r.typeError(key, "table", v)
+		return nil
+	}
+	return t
+}
+
+// Tables of the table key by their names
+func (r *Reader) Tables(key string) map[string]*toml.Tree {
+	t := r.Table(key)
+	if t == nil {
+		return nil
+	}
+	tables := make(map[string]*toml.Tree)
+	for _, name := range t.Keys() {
+		v := t.Get(name)
+		if sub, ok := v.(*toml.Tree); ok {
+			tables[name] = sub
+		} else {
+			r.typeError(key+"."+name, "table", v)
+		}
+	}
+	return tables
+}
+
+// Array of tables ([[key]])
+func (r *Reader) Array(key string) []*toml.Tree {
+	v := r.get(key)
+	if v == nil {
+		return nil
+	}
+	tables, ok := v.([]*toml.Tree)
+	if !ok {
+		r.typeError(key, "array of tables", v)
+		return nil
+	}
+	return tables
+}
+
+// StringMap is a table of strings
+func (r *Reader) StringMap(key string) map[string]string {
+	t := r.Table(key)
+	if t == nil {
+		return nil
+	}
+	m := make(map[string]string)
+	for _, name := range t.Keys() {
+		if s, ok := t.Get(name).(string); ok {
+			m[name] = s
+		} else {
+			r.typeError(key+"."+name, "string", t.Get(name))
+		}
+	}
+	return m
+}
+
+// Unmarshal the table t of key into v. Keys without fields in v are errors.
+func (r *Reader) Unmarshal(key string, t *toml.Tree, v interface{}) bool {
+	r.used[key] = true
+	if err := toml.NewDecoder(strings.NewReader(t.String())).Strict(true).Decode(v); err != nil {
+		r.ErrorAt(key, t, "%v", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package settings
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+const testConf = `
+[server]
+listen = ":3020"
+getfileexpire = "7200"
+verifydownload = 1
+trustedproxies = ["127.0.0.1", 2]
+
+[update]
+reload = 0
+
+[transcoder]
+tolerance = 2
+concurrency = 4
+
+[remote.locations]
+nforce = "https://nl.files.kbb1.com/get/"
+ovh = 5
+
+[[hooks]]
+url = "http://a"
+`
+
+func TestReader(t *testing.T) {
+	tree, err := toml.Load(testConf)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	r := NewReader(tree)
+
+	if s := r.String("server.listen", ""); s != ":3020" {
+		t.Errorf("String = %q, expected :3020", s)
+	}
+	if d := r.Seconds("server.getfileexpire", 60); d != time.Minute {
+		t.Errorf("Seconds of a wrong type = %v, expected the default", d)
+	}
+	if b := r.Bool("server.verifydownload", false); b {
+		t.Errorf("Bool of a wrong type = true, expected the default")
+	}
+	r.Strings("server.trustedproxies", nil)
+	if d := r.Interval("update.reload", 10); d != 10*time.Second {
+		t.Errorf("Interval out of range = %v, expected the default", d)
+	}
+	if f := r.Float("transcoder.tolerance", 1, 0, 60); f != 2 {
+		t.Errorf("Float of an integer = %g, expected 2", f)
+	}
+	if n := r.Int("transcoder.concurrency", 0, 0, 64); n != 4 {
+		t.Errorf("Int = %d, expected 4", n)
+	}
+	if m := r.StringMap("remote.locations"); len(m) != 1 {
+		t.Errorf("StringMap = %v, expected 1 location", m)
+	}
+	if a := r.Array("hooks"); len(a) != 1 {
+		t.Errorf("Array = %d tables, expected 1", len(a))
+	}
+	if r.Required("index.dir") {
+		t.Errorf("Required of a missing key = true")
+	}
+	// sorted by lines
+	r.Errorf("server.listen", "address in use")
+
+	errs, ok := r.Err().(Errors)
+	if !ok {
+		t.Fatalf("Err = %v, expected Errors", r.Err())
+	}
+	expect := []string{
+		`line 3: server.listen: address in use`,
+		`line 4: server.getfileexpire: expected integer, got string "7200"`,
+		`line 5: server.verifydownload: expected true or false, got int64`,
+		`line 6: server.trustedproxies: expected array of strings, got int64`,
+		`line 9: update.reload: 0 is out of range [1, 4294967296]`,
+		`line 17: remote.locations.ovh: expected string, got int64`,
+		`index.dir: required`,
+	}
+	if len(errs) != len(expect) {
+		t.Fatalf("Errors:\n%v\nexpected %d errors", errs, len(expect))
+	}
+	for i, e := range errs {
+		if e.Error() != expect[i] {
+			t.Errorf("Error %d = %s, expected %s", i, e, expect[i])
+		}
+	}
+	if !strings.Contains(r.Err().Error(), "\n") {
+		t.Errorf("Errors are not reported together")
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	tree, err := toml.Load(`
+[update]
+relaod = 10
+basedir = "/"
+
+[remote.locations]
+nforce = "https://nl.files.kbb1.com/get/"
+
+[keys.a]
+token = "abc"
+scope = ["admin"]
+`)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	r := NewReader(tree)
+	r.String("update.basedir", "/")
+	r.Interval("update.reload", 10)
+	r.StringMap("remote.locations")
+	for name, k := range r.Tables("keys") {
+		var key struct {
+			Token  string   `toml:"token"`
+			Scopes []string `toml:"scopes"`
+		}
+		r.Unmarshal("keys."+name, k, &key)
+	}
+	r.Unknown()
+
+	expect := "line 3: update.relaod: unknown setting\n" +
+		`line 9: keys.a: undecoded keys: ["scope"]`
+	if err := r.Err(); err == nil || err.Error() != expect {
+		t.Errorf("Errors:\n%v\nexpected:\n%s", err, expect)
+	}
+}
@@ -0,0 +1,33 @@
+package signing
+
+import (
+	"net"
+	"strings"
+)
+
+// ParseClient parses the client binding of a signed URL: an IP address or a CIDR
+func ParseClient(client string) (*net.IPNet, error) {
+	if strings.Contains(client, "/") {
+		_, ipnet, err := net.ParseCIDR(client)
+		return ipnet, err
+	}
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: client}
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// MatchClient reports whether ip belongs to the client binding
+func MatchClient(client, ip string) bool {
+	ipnet, err := ParseClient(client)
+	if err != nil {
+		return false
+	}
+	addr := net.ParseIP(ip)
+	return addr != nil && ipnet.Contains(addr)
+}
@@ -0,0 +1,32 @@
+package signing
+
+import (
+	"testing"
+)
+
+func TestMatchClient(t *testing.T) {
+	tests := []struct {
+		client string
+		ip     string
+		match  bool
+	}{
+		{"10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.1", "10.0.0.2", false},
+		{"10.0.0.0/24", "10.0.0.200", true},
+		{"10.0.0.0/24", "10.0.1.1", false},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"2001:db8::/32", "2001:db8:1::5", true},
+		{"10.0.0.1", "::ffff:10.0.0.1", true},
+		{"10.0.0.1", "", false},
+		{"wrong", "10.0.0.1", false},
+	}
+	for _, x := range tests {
+		if m := MatchClient(x.client, x.ip); m != x.match {
+			t.Errorf("MatchClient(%q, %q) = %v, expected %v", x.client, x.ip, m, x.match)
+		}
+	}
+
+	if _, err := ParseClient("10.0.0.300"); err == nil {
+		t.Errorf("ParseClient: expected error")
+	}
+}
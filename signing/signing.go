@@ -0,0 +1,89 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Keys signs download URLs with HMAC-SHA256. New signatures use the Current key,
+// any key of Keys is accepted for verification, so keys can be rotated.
+type Keys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+var (
+	ErrExpired    = errors.New("The signature has expired")
+	ErrNoKey      = errors.New("Unknown signing key")
+	ErrNoSign     = errors.New("No signature")
+	ErrSignature  = errors.New("Wrong signature")
+	ErrWrongValue = errors.New("Wrong signature parameters")
+)
+
+// Query parameters of a signed URL
+const (
+	ParamClientIP = "clientip"
+	ParamExpires  = "expires"
+	ParamKey      = "key"
+	ParamSign     = "sign"
+)
+
+func mac(key []byte, sha1, name, clientip string, expires int64) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(sha1 + "\n" + name + "\n" + clientip + "\n" + strconv.FormatInt(expires, 10)))
+	return h.Sum(nil)
+}
+
+// Sign sha1/name valid until expires and optionally bound to clientip.
+// It returns the query parameters of the URL.
+func (k *Keys) Sign(sha1, name, clientip string, expires time.Time) (url.Values, error) {
+	key, ok := k.Keys[k.Current]
+	if !ok {
+		return nil, ErrNoKey
+	}
+
+	exp := expires.Unix()
+	q := url.Values{}
+	if clientip != "" {
+		q.Set(ParamClientIP, clientip)
+	}
+	q.Set(ParamExpires, strconv.FormatInt(exp, 10))
+	q.Set(ParamKey, k.Current)
+	q.Set(ParamSign, base64.RawURLEncoding.EncodeToString(mac(key, sha1, name, clientip, exp)))
+	return q, nil
+}
+
+// Verify the signature of sha1/name in the query parameters q.
+// It returns the client IP the URL is bound to.
+func (k *Keys) Verify(sha1, name string, q url.Values, now time.Time) (string, error) {
+	sign := q.Get(ParamSign)
+	if sign == "" {
+		return "", ErrNoSign
+	}
+	key, ok := k.Keys[q.Get(ParamKey)]
+	if !ok {
+		return "", ErrNoKey
+	}
+	exp, err := strconv.ParseInt(q.Get(ParamExpires), 10, 64)
+	if err != nil {
+		return "", ErrWrongValue
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(sign)
+	if err != nil {
+		return "", ErrWrongValue
+	}
+
+	clientip := q.Get(ParamClientIP)
+	if !hmac.Equal(sum, mac(key, sha1, name, clientip, exp)) {
+		return "", ErrSignature
+	}
+	if now.Unix() >= exp {
+		return "", ErrExpired
+	}
+	return clientip, nil
+}
@@ -0,0 +1,47 @@
+package signing
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	sha1 = "81491a32fb7e255f97ebd015189ca2bcb1d5b498"
+	name = "heb_o_norav_achana_2017-01-01_lesson.mp4"
+)
+
+func TestSign(t *testing.T) {
+	now := time.Now()
+	k := &Keys{Current: "new", Keys: map[string][]byte{"new": []byte("secret2"), "old": []byte("secret1")}}
+
+	q, err := k.Sign(sha1, name, "10.0.0.1", now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if ip, err := k.Verify(sha1, name, q, now); err != nil || ip != "10.0.0.1" {
+		t.Errorf("Verify = %q, %v, expected 10.0.0.1", ip, err)
+	}
+	if _, err := k.Verify(sha1, name, q, now.Add(2*time.Hour)); err != ErrExpired {
+		t.Errorf("Verify expired = %v, expected %v", err, ErrExpired)
+	}
+	if _, err := k.Verify(sha1, "other.mp4", q, now); err != ErrSignature {
+		t.Errorf("Verify other name = %v, expected %v", err, ErrSignature)
+	}
+
+	q.Set(ParamClientIP, "10.0.0.2")
+	if _, err := k.Verify(sha1, name, q, now); err != ErrSignature {
+		t.Errorf("Verify other client = %v, expected %v", err, ErrSignature)
+	}
+
+	// rotated key is still accepted
+	old := &Keys{Current: "old", Keys: k.Keys}
+	q, _ = old.Sign(sha1, name, "", now.Add(time.Hour))
+	if _, err := k.Verify(sha1, name, q, now); err != nil {
+		t.Errorf("Verify old key: %v", err)
+	}
+
+	delete(k.Keys, "old")
+	if _, err := k.Verify(sha1, name, q, now); err != ErrNoKey {
+		t.Errorf("Verify removed key = %v, expected %v", err, ErrNoKey)
+	}
+}
@@ -9,13 +9,26 @@ import (
 
 type (
 	FFstream struct {
-		Codec     string `json:"codec_name"`
-		Type      string `json:"codec_type"`
-		FrameRate string `json:"r_frame_rate"`
-		BitRate   int64  `json:"bit_rate,string"`
-		Channels  int64  `json:"channels"`
-		Width     int64  `json:"width"`
-		Height    int64  `json:"height"`
+		Index       int           `json:"index"`
+		Codec       string        `json:"codec_name"`
+		Type        string        `json:"codec_type"`
+		FrameRate   string        `json:"r_frame_rate"`
+		BitRate     int64         `json:"bit_rate,string"`
+		Channels    int64         `json:"channels"`
+		Width       int64         `json:"width"`
+		Height      int64         `json:"height"`
+		Tags        FFtags        `json:"tags"`
+		Disposition FFdisposition `json:"disposition"`
+	}
+
+	FFtags struct {
+		Language string `json:"language"`
+		Title    string `json:"title"`
+	}
+
+	FFdisposition struct {
+		Default     int `json:"default"`
+		AttachedPic int `json:"attached_pic"`
 	}
 
 	FFformat struct {
@@ -25,8 +38,8 @@ type (
 	}
 
 	FFprobe struct {
-		Format  FFformat    `json:"format", mapstructure:"format"`
-		Streams []*FFstream `json:"streams, mapstructure:"streams"`
+		Format  FFformat    `json:"format" mapstructure:"format"`
+		Streams []*FFstream `json:"streams" mapstructure:"streams"`
 	}
 )
 
@@ -0,0 +1,201 @@
+package transcode
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a transcoding job
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+type (
+	Job struct {
+		ID         string     `json:"id"`
+		State      string     `json:"state"`
+		SHA1       string     `json:"sha1"`     // source file
+		Preset     string     `json:"preset"`   // name of the preset
+		Duration   float64    `json:"duration"` // duration of the source, seconds
+		Estimate   int64      `json:"estimate"` // estimated size of the output, bytes
+		Args       string     `json:"args"`     // ffmpeg arguments of the output
+		Priority   int        `json:"priority"`
+		Source     string     `json:"source"`
+		Target     string     `json:"target"`
+		TargetSHA1 string     `json:"target_sha1,omitempty"`
+		Error      string     `json:"error,omitempty"` // ffmpeg error output
+		Created    time.Time  `json:"created"`
+		Started    *time.Time `json:"started,omitempty"`
+		Finished   *time.Time `json:"finished,omitempty"`
+		Progress   *Progress  `json:"progress,omitempty"` // of a running job, not stored
+	}
+
+	// JobStore keeps transcoding jobs as JSON files in a folder,
+	// one file per job. Finished jobs are removed after Keep.
+	JobStore struct {
+		sync.Mutex
+		Keep time.Duration
+		dir  string
+		jobs map[string]*Job
+	}
+)
+
+const jobExt = ".json"
+
+func (job *Job) IsFinished() bool {
+	return job.State == JobDone || job.State == JobFailed || job.State == JobCanceled
+}
+
+// Open the job store in dir and load all jobs
+func NewJobStore(dir string, keep time.Duration) (*JobStore, error) {
+	s := &JobStore{Keep: keep, dir: dir, jobs: make(map[string]*Job)}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload all jobs from the folder, e.g. after another process has changed them
+func (s *JobStore) Reload() error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+jobExt))
+	if err != nil {
+		return err
+	}
+	jobs := make(map[string]*Job, len(files))
+	for _, path := range files {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		job := new(Job)
+		if err := json.Unmarshal(b, job); err != nil || job.ID+jobExt != filepath.Base(path) {
+			os.Rename(path, strings.TrimSuffix(path, jobExt)+".bad")
+			continue
+		}
+		if job.Args == "" {
+			upgradeJob(job, b)
+		}
+		jobs[job.ID] = job
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.jobs = jobs
+	s.prune(time.Now())
+	return nil
+}
+
+// Jobs of older versions keep the name of the preset in "format"
+// and the ffmpeg arguments in "preset"
+func upgradeJob(job *Job, b []byte) {
+	var old struct {
+		Format string `json:"format"`
+	}
+	if json.Unmarshal(b, &old) == nil && old.Format != "" {
+		job.Args, job.Preset = job.Preset, old.Format
+	}
+}
+
+// Add a new job
+func (s *JobStore) Add(job *Job) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.prune(time.Now())
+	if err := s.save(job); err != nil {
+		return err
+	}
+	s.jobs[job.ID] = job
+	return nil
+}
+
+// Get a copy of the job
+func (s *JobStore) Get(id string) (Job, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if job, ok := s.jobs[id]; ok {
+		return *job, true
+	}
+	return Job{}, false
+}
+
+// Pending returns unfinished jobs in the order of creation
+func (s *JobStore) Pending() []Job {
+	s.Lock()
+	defer s.Unlock()
+
+	jobs := make([]Job, 0)
+	for _, job := range s.jobs {
+		if !job.IsFinished() {
+			jobs = append(jobs, *job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+	return jobs
+}
+
+// Update the job with f and save it
+func (s *JobStore) Update(id string, f func(job *Job)) error {
+	s.Lock()
+	defer s.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+	x := *job
+	f(&x)
+	x.Progress = nil
+	if err := s.save(&x); err != nil {
+		return err
+	}
+	*job = x
+	return nil
+}
+
+// Remove finished jobs older than Keep
+func (s *JobStore) prune(now time.Time) {
+	if s.Keep <= 0 {
+		return
+	}
+	for id, job := range s.jobs {
+		if job.IsFinished() && job.Finished != nil && now.Sub(*job.Finished) > s.Keep {
+			os.Remove(s.path(id))
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func (s *JobStore) path(id string) string {
+	return filepath.Join(s.dir, id+jobExt)
+}
+
+func (s *JobStore) save(job *Job) error {
+	b, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := s.path(job.ID)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
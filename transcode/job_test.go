@@ -0,0 +1,78 @@
+package transcode
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJobStore(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	s, err := NewJobStore(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewJobStore: %v", err)
+	}
+
+	old := now.Add(-2 * time.Hour)
+	jobs := []*Job{
+		{ID: "a", State: JobQueued, Created: now.Add(time.Second)},
+		{ID: "b", State: JobRunning, Created: now},
+		{ID: "c", State: JobDone, Created: old, Finished: &old},
+		{ID: "d", State: JobFailed, Created: now, Finished: &now},
+	}
+	for _, job := range jobs {
+		if err := s.Add(job); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	err = s.Update("a", func(job *Job) {
+		job.State = JobRunning
+		job.Started = &now
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := s.Update("x", func(job *Job) {}); err == nil {
+		t.Errorf("Update of unknown job: expected error")
+	}
+
+	// reopen and prune the expired job
+	s, err = NewJobStore(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewJobStore: %v", err)
+	}
+	if _, ok := s.Get("c"); ok {
+		t.Errorf("Expired job has not been removed")
+	}
+	if job, ok := s.Get("a"); !ok || job.State != JobRunning || job.Started == nil {
+		t.Errorf("Job a = %+v, expected running", job)
+	}
+	if job, ok := s.Get("d"); !ok || job.State != JobFailed {
+		t.Errorf("Job d = %+v, expected failed", job)
+	}
+
+	pending := s.Pending()
+	if len(pending) != 2 || pending[0].ID != "b" || pending[1].ID != "a" {
+		t.Errorf("Pending = %+v, expected jobs b, a", pending)
+	}
+}
+
+func TestJobStoreOldJob(t *testing.T) {
+	dir := t.TempDir()
+	b := []byte(`{"id": "a", "state": "queued", "format": "mp4", "preset": "-c:v libx264"}`)
+	if err := os.WriteFile(filepath.Join(dir, "a.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewJobStore(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewJobStore: %v", err)
+	}
+	if job, ok := s.Get("a"); !ok || job.Preset != "mp4" || job.Args != "-c:v libx264" {
+		t.Errorf("Job a = %+v, expected preset mp4 with its args", job)
+	}
+}
@@ -0,0 +1,244 @@
+package transcode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type (
+	// Rung of a bitrate ladder. It applies to sources with the bitrate
+	// starting from From and with Channels audio channels (0 for any).
+	Rung struct {
+		Channels int64 `json:"channels" toml:"channels"` // audio channels of the source
+		From     int64 `json:"from" toml:"from"`         // bitrate of the source, bit/s
+		Bitrate  int64 `json:"bitrate" toml:"bitrate"`   // target bitrate, kbit/s
+	}
+
+	Ladder []Rung
+
+	// Preset describes an output format and how to choose its bitrates
+	Preset struct {
+		Name   string `json:"name" toml:"-"`
+		Ext    string `json:"ext" toml:"ext"`       // extension of the output file
+		Suffix string `json:"suffix" toml:"suffix"` // suffix of the destination file name
+		VCodec string `json:"vcodec" toml:"vcodec"` // empty for audio only output
+		VArgs  string `json:"vargs" toml:"vargs"`
+		Height int64  `json:"height" toml:"height"` // scale down to the height
+		Video  Ladder `json:"video" toml:"video"`
+		ACodec string `json:"acodec" toml:"acodec"`
+		AArgs  string `json:"aargs" toml:"aargs"`
+		Audio  Ladder `json:"audio" toml:"audio"`
+		Args   string `json:"args" toml:"args"` // extra ffmpeg arguments
+	}
+
+	// Select the audio stream by the stream index or by the language tag.
+	// The zero value selects the default audio stream.
+	Select struct {
+		Index    *int
+		Language string
+	}
+
+	// Plan is ffmpeg arguments for a source
+	Plan struct {
+		Args     string
+		Audio    *FFstream
+		Video    *FFstream
+		ABitrate int64 // kbit/s
+		VBitrate int64 // kbit/s
+	}
+)
+
+var (
+	ErrNoPreset = errors.New("No preset")
+	ErrNoStream = errors.New("No selected audio stream")
+
+	// Mono sources have lower audio bitrates, stereo ones up to 96k
+	aacLadder = Ladder{{1, 0, 32}, {1, 40000, 48}, {1, 62000, 64}, {0, 0, 64}, {0, 90001, 96}}
+
+	// Builtin presets, the name is the format of a transcoding request
+	Presets = map[string]*Preset{
+		"mp4": {
+			Name:   "mp4",
+			Ext:    ".mp4",
+			VCodec: "libx264",
+			VArgs:  "-profile:v main -preset fast",
+			Video:  Ladder{{0, 0, 128}, {0, 180000, 256}, {0, 400001, 384}, {0, 600001, 512}},
+			ACodec: "libfdk_aac",
+			Audio:  aacLadder,
+		},
+		"mp4-360p": {
+			Name:   "mp4-360p",
+			Ext:    ".mp4",
+			Suffix: "_360p",
+			VCodec: "libx264",
+			VArgs:  "-profile:v main -preset fast",
+			Height: 360,
+			Video:  Ladder{{0, 0, 128}, {0, 180000, 192}, {0, 400001, 256}},
+			ACodec: "libfdk_aac",
+			Audio:  Ladder{{1, 0, 32}, {1, 40000, 48}, {0, 0, 64}},
+		},
+		"m4a": {
+			Name:   "m4a",
+			Ext:    ".m4a",
+			ACodec: "libfdk_aac",
+			Audio:  aacLadder,
+		},
+		"mp3": {
+			Name:   "mp3",
+			Ext:    ".mp3",
+			ACodec: "libmp3lame",
+			Audio:  Ladder{{1, 0, 32}, {1, 40000, 48}, {1, 62000, 64}, {0, 0, 64}, {0, 90001, 96}, {0, 150001, 128}},
+		},
+		"webm": {
+			Name:   "webm",
+			Ext:    ".webm",
+			VCodec: "libvpx-vp9",
+			VArgs:  "-deadline good -cpu-used 2 -row-mt 1",
+			Video:  Ladder{{0, 0, 96}, {0, 180000, 192}, {0, 400001, 256}, {0, 600001, 384}},
+			ACodec: "libopus",
+			Audio:  Ladder{{1, 0, 24}, {1, 40000, 32}, {1, 62000, 48}, {0, 0, 48}, {0, 90001, 64}},
+		},
+	}
+)
+
+// Bitrate of the last rung for the source. Rungs for the exact number
+// of channels take precedence over rungs for any number of channels.
+func (l Ladder) Bitrate(bitrate, channels int64) int64 {
+	var br int64
+	for _, exact := range []bool{true, false} {
+		for _, r := range l {
+			if (exact && r.Channels == channels) || (!exact && r.Channels == 0) {
+				if r.From <= bitrate {
+					br = r.Bitrate
+				}
+			}
+		}
+		if br > 0 {
+			return br
+		}
+	}
+	return br
+}
+
+// Validate the preset configuration
+func (p *Preset) Validate() error {
+	if !strings.HasPrefix(p.Ext, ".") {
+		return errors.New("ext must start with a dot")
+	}
+	if p.ACodec == "" || len(p.Audio) == 0 {
+		return errors.New("acodec and audio ladder are required")
+	}
+	if p.VCodec != "" && len(p.Video) == 0 {
+		return errors.New("vcodec requires video ladder")
+	}
+	return nil
+}
+
+func (p *Preset) IsAudio() bool {
+	return p.VCodec == ""
+}
+
+// Plan the ffmpeg arguments for the probed source
+func (p *Preset) Plan(probe *FFprobe, sel Select) (*Plan, error) {
+	audio, video, err := streams(probe, sel)
+	if err != nil {
+		return nil, err
+	}
+	if video == nil && !p.IsAudio() {
+		return nil, ErrNoPreset
+	}
+
+	plan := &Plan{Audio: audio}
+	args := make([]string, 0, 20)
+
+	// map the chosen streams if the source has other ones
+	nstreams := 1
+	if !p.IsAudio() {
+		nstreams = 2
+	}
+	if len(probe.Streams) > nstreams {
+		if !p.IsAudio() {
+			args = append(args, fmt.Sprintf("-map 0:%d", video.Index))
+		}
+		args = append(args, fmt.Sprintf("-map 0:%d", audio.Index))
+	}
+
+	if p.IsAudio() {
+		args = append(args, "-vn")
+	} else {
+		plan.Video = video
+		vr := video.BitRate
+		if vr == 0 {
+			vr = videoBitrate(probe, video)
+		}
+		plan.VBitrate = p.Video.Bitrate(vr, 0)
+
+		args = append(args, "-c:v", p.VCodec, p.VArgs, fmt.Sprintf("-b:v %dk", plan.VBitrate))
+		if video.FrameRate == "1000/1" {
+			args = append(args, "-vsync vfr")
+		}
+		if p.Height > 0 && video.Height > p.Height {
+			args = append(args, fmt.Sprintf("-vf scale=-2:%d", p.Height))
+		}
+	}
+
+	plan.ABitrate = p.Audio.Bitrate(audio.BitRate, audio.Channels)
+	args = append(args, "-c:a", p.ACodec, p.AArgs, fmt.Sprintf("-b:a %dk", plan.ABitrate))
+	args = append(args, p.Args)
+
+	plan.Args = strings.Join(strings.Fields(strings.Join(args, " ")), " ")
+	return plan, nil
+}
+
+// Estimate the bitrate of the video stream without its own bit_rate:
+// the overall bitrate minus all other streams, e.g. every audio track
+func videoBitrate(probe *FFprobe, video *FFstream) int64 {
+	vr := probe.Format.BitRate
+	for _, st := range probe.Streams {
+		if st != video {
+			vr -= st.BitRate
+		}
+	}
+	if vr < 0 {
+		return 0
+	}
+	return vr
+}
+
+// Choose the audio and the video streams of the source. Subtitle, data and
+// attachment streams are skipped as well as pictures attached as video.
+// The default streams are preferred unless sel chooses the audio.
+func streams(probe *FFprobe, sel Select) (audio *FFstream, video *FFstream, err error) {
+	for _, st := range probe.Streams {
+		switch st.Type {
+		case "video":
+			if st.Disposition.AttachedPic != 0 {
+				continue
+			}
+			if video == nil || (st.Disposition.Default != 0 && video.Disposition.Default == 0) {
+				video = st
+			}
+		case "audio":
+			if sel.Index != nil {
+				if st.Index == *sel.Index {
+					audio = st
+				}
+			} else if sel.Language != "" {
+				if audio == nil && strings.EqualFold(st.Tags.Language, sel.Language) {
+					audio = st
+				}
+			} else if audio == nil || (st.Disposition.Default != 0 && audio.Disposition.Default == 0) {
+				audio = st
+			}
+		}
+	}
+
+	if audio == nil {
+		if sel.Index != nil || sel.Language != "" {
+			return nil, nil, ErrNoStream
+		}
+		return nil, nil, ErrNoPreset
+	}
+	return audio, video, nil
+}
@@ -0,0 +1,181 @@
+package transcode
+
+import (
+	"fmt"
+	"testing"
+)
+
+// The former hardcoded mp4 preset
+func preset0(probe *FFprobe) string {
+	audio, video, _ := streams(probe, Select{})
+
+	abitrate := 64
+	if audio.Channels == 1 {
+		if audio.BitRate < 40000 {
+			abitrate = 32
+		} else if audio.BitRate < 62000 {
+			abitrate = 48
+		}
+	} else {
+		if audio.BitRate > 90000 {
+			abitrate = 96
+		}
+	}
+
+	vbitrate := 256
+	vr := video.BitRate
+	if vr == 0 {
+		vr = probe.Format.BitRate - audio.BitRate
+	}
+	if vr < 180000 {
+		vbitrate = 128
+	} else if vr > 600000 {
+		vbitrate = 512
+	} else if vr > 400000 {
+		vbitrate = 384
+	}
+
+	vsync := ""
+	if video.FrameRate == "1000/1" {
+		vsync = "-vsync vfr "
+	}
+
+	return fmt.Sprintf("-c:v libx264 -profile:v main -preset fast -b:v %dk %s-c:a libfdk_aac -b:a %dk", vbitrate, vsync, abitrate)
+}
+
+func TestPresetMP4(t *testing.T) {
+	for _, channels := range []int64{1, 2} {
+		for _, ar := range []int64{0, 32000, 39999, 40000, 61999, 62000, 90000, 90001, 128000} {
+			for _, vr := range []int64{0, 100000, 179999, 180000, 400000, 400001, 600000, 600001, 1000000} {
+				for _, fr := range []string{"25/1", "1000/1"} {
+					probe := &FFprobe{
+						Format: FFformat{BitRate: 500000},
+						Streams: []*FFstream{
+							{Type: "video", BitRate: vr, FrameRate: fr},
+							{Type: "audio", BitRate: ar, Channels: channels},
+						},
+					}
+					plan, err := Presets["mp4"].Plan(probe, Select{})
+					if err != nil {
+						t.Fatalf("Plan: %v", err)
+					}
+					if expect := preset0(probe); plan.Args != expect {
+						t.Errorf("Plan = %q, expected %q", plan.Args, expect)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPresetStreams(t *testing.T) {
+	probe := &FFprobe{
+		Streams: []*FFstream{
+			{Index: 0, Type: "video", BitRate: 1000000, FrameRate: "25/1"},
+			{Index: 1, Type: "audio", BitRate: 128000, Channels: 2, Tags: FFtags{Language: "heb"}},
+			{Index: 2, Type: "audio", BitRate: 64000, Channels: 1, Tags: FFtags{Language: "rus"}, Disposition: FFdisposition{Default: 1}},
+			{Index: 3, Type: "audio", BitRate: 128000, Channels: 2, Tags: FFtags{Language: "eng"}},
+			{Index: 4, Type: "subtitle"},
+			{Index: 5, Type: "data"},
+			{Index: 6, Type: "video", Disposition: FFdisposition{AttachedPic: 1}},
+		},
+	}
+	index := 3
+	tests := []struct {
+		sel    Select
+		expect string
+		err    error
+	}{
+		{Select{}, "-map 0:2 -vn -c:a libmp3lame -b:a 64k", nil},
+		{Select{Language: "HEB"}, "-map 0:1 -vn -c:a libmp3lame -b:a 96k", nil},
+		{Select{Index: &index}, "-map 0:3 -vn -c:a libmp3lame -b:a 96k", nil},
+		{Select{Language: "spa"}, "", ErrNoStream},
+	}
+	for _, x := range tests {
+		plan, err := Presets["mp3"].Plan(probe, x.sel)
+		if err != x.err {
+			t.Errorf("Plan %+v error = %v, expected %v", x.sel, err, x.err)
+			continue
+		}
+		if err == nil && plan.Args != x.expect {
+			t.Errorf("Plan %+v = %q, expected %q", x.sel, plan.Args, x.expect)
+		}
+	}
+
+	plan, err := Presets["mp4"].Plan(probe, Select{Language: "eng"})
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if expect := "-map 0:0 -map 0:3 -c:v libx264 -profile:v main -preset fast -b:v 512k -c:a libfdk_aac -b:a 96k"; plan.Args != expect {
+		t.Errorf("Plan = %q, expected %q", plan.Args, expect)
+	}
+}
+
+func TestVideoBitrate(t *testing.T) {
+	probe := &FFprobe{
+		Format: FFformat{BitRate: 700000},
+		Streams: []*FFstream{
+			{Index: 0, Type: "video", FrameRate: "25/1"},
+			{Index: 1, Type: "audio", BitRate: 128000, Channels: 2},
+			{Index: 2, Type: "audio", BitRate: 128000, Channels: 2},
+			{Index: 3, Type: "audio", BitRate: 128000, Channels: 2},
+		},
+	}
+	// 700000 - 3 * 128000 = 316000, not 572000 of the selected track only
+	plan, err := Presets["mp4"].Plan(probe, Select{})
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if plan.VBitrate != 256 {
+		t.Errorf("Video bitrate = %dk, expected 256k", plan.VBitrate)
+	}
+}
+
+func TestPresetAudio(t *testing.T) {
+	probe := &FFprobe{
+		Streams: []*FFstream{
+			{Type: "audio", BitRate: 128000, Channels: 2},
+		},
+	}
+	if _, err := Presets["mp4"].Plan(probe, Select{}); err != ErrNoPreset {
+		t.Errorf("Plan of mp4 from audio = %v, expected %v", err, ErrNoPreset)
+	}
+
+	plan, err := Presets["mp3"].Plan(probe, Select{})
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if expect := "-vn -c:a libmp3lame -b:a 96k"; plan.Args != expect {
+		t.Errorf("Plan = %q, expected %q", plan.Args, expect)
+	}
+}
+
+func TestPresetScale(t *testing.T) {
+	probe := &FFprobe{
+		Streams: []*FFstream{
+			{Type: "video", BitRate: 1000000, Height: 720, FrameRate: "25/1"},
+			{Type: "audio", BitRate: 128000, Channels: 2},
+		},
+	}
+	plan, err := Presets["mp4-360p"].Plan(probe, Select{})
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	expect := "-c:v libx264 -profile:v main -preset fast -b:v 256k -vf scale=-2:360 -c:a libfdk_aac -b:a 64k"
+	if plan.Args != expect {
+		t.Errorf("Plan = %q, expected %q", plan.Args, expect)
+	}
+}
+
+func TestPresetValidate(t *testing.T) {
+	for name, p := range Presets {
+		if err := p.Validate(); err != nil {
+			t.Errorf("Preset %s: %v", name, err)
+		}
+	}
+
+	p := &Preset{Ext: ".mp4", VCodec: "libx264", ACodec: "aac", Audio: Ladder{{0, 0, 64}}}
+	if err := p.Validate(); err == nil {
+		t.Errorf("Preset without video ladder: expected error")
+	}
+}
@@ -0,0 +1,69 @@
+package transcode
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress of a running transcoding
+type Progress struct {
+	Percent float64 `json:"percent"`
+	Speed   float64 `json:"speed"` // relative to the real time
+	ETA     int64   `json:"eta"`   // seconds
+	Time    float64 `json:"time"`  // transcoded duration, seconds
+}
+
+// Parse the output of "ffmpeg -progress" and call update for every block.
+// The duration of the source is used to calculate the percent and the ETA.
+func parseProgress(r io.Reader, duration float64, update func(p Progress)) {
+	var p Progress
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "out_time_us", "out_time_ms": // both are microseconds
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				p.Time = float64(us) / 1e6
+			}
+		case "speed":
+			if x, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64); err == nil {
+				p.Speed = x
+			}
+		case "progress":
+			if value == "end" && duration > 0 {
+				p.Time = duration
+			}
+			p.calc(duration)
+			update(p)
+		}
+	}
+}
+
+func (p *Progress) calc(duration float64) {
+	if duration <= 0 {
+		return
+	}
+	p.Percent = p.Time * 100 / duration
+	if p.Percent > 100 {
+		p.Percent = 100
+	}
+	if p.Speed > 0 {
+		p.ETA = int64((duration - p.Time) / p.Speed)
+		if p.ETA < 0 {
+			p.ETA = 0
+		}
+	}
+}
+
+func (p Progress) String() string {
+	return strconv.FormatFloat(p.Percent, 'f', 1, 64) + "% speed " +
+		strconv.FormatFloat(p.Speed, 'f', 2, 64) + "x ETA " +
+		(time.Duration(p.ETA) * time.Second).String()
+}
@@ -0,0 +1,41 @@
+package transcode
+
+import (
+	"strings"
+	"testing"
+)
+
+const ffmpegProgress = `frame=100
+fps=50.0
+out_time_us=30000000
+out_time=00:00:30.000000
+speed=2.00x
+progress=continue
+out_time_ms=60000000
+speed=N/A
+progress=continue
+out_time_us=110000000
+speed=2.5x
+progress=end
+`
+
+func TestParseProgress(t *testing.T) {
+	ll := make([]Progress, 0)
+	parseProgress(strings.NewReader(ffmpegProgress), 120, func(p Progress) {
+		ll = append(ll, p)
+	})
+
+	expect := []Progress{
+		{Percent: 25, Speed: 2, ETA: 45, Time: 30},
+		{Percent: 50, Speed: 2, ETA: 30, Time: 60},
+		{Percent: 100, Speed: 2.5, ETA: 0, Time: 120},
+	}
+	if len(ll) != len(expect) {
+		t.Fatalf("Progress updates = %d, expected %d", len(ll), len(expect))
+	}
+	for i, p := range ll {
+		if p != expect[i] {
+			t.Errorf("Progress %d = %+v, expected %+v", i, p, expect[i])
+		}
+	}
+}
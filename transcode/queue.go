@@ -0,0 +1,74 @@
+package transcode
+
+import (
+	"container/heap"
+)
+
+type (
+	queueItem struct {
+		task  TranscodeTask
+		seq   uint64
+		index int
+	}
+
+	// taskQueue is a heap of tasks ordered by priority, then by arrival
+	taskQueue []*queueItem
+)
+
+func (q taskQueue) Len() int { return len(q) }
+
+func (q taskQueue) Less(i, j int) bool {
+	if q[i].task.Priority != q[j].task.Priority {
+		return q[i].task.Priority > q[j].task.Priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q taskQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *taskQueue) Push(x interface{}) {
+	item := x.(*queueItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *taskQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
+
+func (q taskQueue) find(id string) *queueItem {
+	for _, item := range q {
+		if item.task.ID == id {
+			return item
+		}
+	}
+	return nil
+}
+
+// Remove the task from the queue
+func (q *taskQueue) remove(id string) (TranscodeTask, bool) {
+	if item := q.find(id); item != nil {
+		heap.Remove(q, item.index)
+		return item.task, true
+	}
+	return TranscodeTask{}, false
+}
+
+// Change the priority of the queued task
+func (q *taskQueue) reprioritize(id string, priority int) bool {
+	if item := q.find(id); item != nil {
+		item.task.Priority = priority
+		heap.Fix(q, item.index)
+		return true
+	}
+	return false
+}
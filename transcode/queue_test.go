@@ -0,0 +1,105 @@
+package transcode
+
+import (
+	"container/heap"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTaskQueue(t *testing.T) {
+	tr := NewMultiTranscoder(0, nil, nil)
+	tasks := []TranscodeTask{
+		{ID: "a"},
+		{ID: "b", Priority: 10},
+		{ID: "c"},
+		{ID: "d", Priority: 10},
+		{ID: "e", Priority: -1},
+	}
+	for _, task := range tasks {
+		if !tr.Transcode(task) {
+			t.Fatalf("Transcode %s: queue is full", task.ID)
+		}
+	}
+
+	if !tr.Reprioritize("c", 20) {
+		t.Errorf("Reprioritize: task c not found")
+	}
+	if !tr.Cancel("a") {
+		t.Errorf("Cancel: task a not found")
+	}
+	if tr.Cancel("x") {
+		t.Errorf("Cancel: unknown task x found")
+	}
+
+	r, _ := tr.Result()
+	if r.Task.ID != "a" || r.Err != ErrCanceled {
+		t.Errorf("Result = %s %v, expected a %v", r.Task.ID, r.Err, ErrCanceled)
+	}
+
+	if n := tr.QueueLen(); n != 4 {
+		t.Errorf("QueueLen = %d, expected 4", n)
+	}
+
+	expect := []string{"c", "b", "d", "e"}
+	for _, id := range expect {
+		item := heap.Pop(&tr.queue).(*queueItem)
+		if item.task.ID != id {
+			t.Errorf("Next task = %s, expected %s", item.task.ID, id)
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	tr := NewMultiTranscoder(2, nil, &Space{Dirs: []string{t.TempDir()}, Reserve: 1 << 62})
+
+	// the task is held for no disk space
+	if !tr.Transcode(TranscodeTask{ID: "a"}) {
+		t.Fatalf("Transcode: queue is full")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if n := tr.Stop(ctx); n != 0 {
+		t.Errorf("Stop = %d, expected 0 stopped tasks", n)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("Stop waited for the held task")
+	}
+	if _, ok := tr.Result(); ok {
+		t.Errorf("Result after Stop = true, expected false")
+	}
+	if tr.Transcode(TranscodeTask{ID: "b"}) || tr.Cancel("a") {
+		t.Errorf("Transcode or Cancel after Stop = true, expected false")
+	}
+	if n := tr.QueueLen(); n != 1 {
+		t.Errorf("QueueLen = %d, expected 1", n)
+	}
+}
+
+func TestResize(t *testing.T) {
+	tr := NewMultiTranscoder(3, nil, nil)
+
+	live := func() int {
+		tr.Lock()
+		defer tr.Unlock()
+		return tr.live
+	}
+	tr.Resize(1)
+	for i := 0; i < 100 && live() != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := live(); n != 1 {
+		t.Errorf("Workers after Resize(1) = %d, expected 1", n)
+	}
+
+	tr.Resize(2)
+	if n := live(); n != 2 || tr.Status().Workers != 2 {
+		t.Errorf("Workers after Resize(2) = %d, status %d, expected 2", n, tr.Status().Workers)
+	}
+
+	tr.Stop(context.Background())
+	if n := live(); n != 0 {
+		t.Errorf("Workers after Stop = %d, expected 0", n)
+	}
+}
@@ -0,0 +1,56 @@
+package transcode
+
+import (
+	"github.com/Bnei-Baruch/filer-backend/fileutils"
+)
+
+type (
+	// Space admits tasks while free space of the folders stays above Reserve
+	Space struct {
+		Dirs    []string
+		Reserve int64 // bytes
+	}
+
+	DiskStatus struct {
+		Path    string `json:"path"`
+		Free    int64  `json:"free"`    // bytes, -1 if unknown
+		Reserve int64  `json:"reserve"` // bytes
+	}
+
+	Status struct {
+		Queue    int          `json:"queue"`
+		Running  int          `json:"running"`
+		Workers  int          `json:"workers"`
+		Reserved int64        `json:"reserved"` // estimated output of queued and running tasks, bytes
+		Disks    []DiskStatus `json:"disks"`
+	}
+)
+
+// Estimate the output size of a plan in bytes with 5% of the container overhead
+func (plan *Plan) Estimate(duration float64) int64 {
+	return int64(duration * float64(plan.ABitrate+plan.VBitrate) * 1000 / 8 * 1.05)
+}
+
+// Admit reports whether need bytes can be written to every folder
+func (s *Space) Admit(need int64) bool {
+	if s == nil {
+		return true
+	}
+	for _, dir := range s.Dirs {
+		if fileutils.DiskAvailable(dir)-s.Reserve < need {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Space) Status() []DiskStatus {
+	if s == nil {
+		return []DiskStatus{}
+	}
+	ds := make([]DiskStatus, 0, len(s.Dirs))
+	for _, dir := range s.Dirs {
+		ds = append(ds, DiskStatus{Path: dir, Free: fileutils.DiskAvailable(dir), Reserve: s.Reserve})
+	}
+	return ds
+}
@@ -0,0 +1,28 @@
+package transcode
+
+import (
+	"testing"
+)
+
+func TestSpace(t *testing.T) {
+	plan := &Plan{ABitrate: 64, VBitrate: 256}
+	if n := plan.Estimate(100); n != 4200000 {
+		t.Errorf("Estimate = %d, expected 4200000", n)
+	}
+
+	s := &Space{Dirs: []string{t.TempDir()}}
+	if !s.Admit(1024) {
+		t.Errorf("Admit 1KB: expected true")
+	}
+	s.Reserve = 1 << 62
+	if s.Admit(1024) {
+		t.Errorf("Admit with a huge reserve: expected false")
+	}
+
+	tr := NewMultiTranscoder(0, nil, s)
+	tr.Transcode(TranscodeTask{ID: "a", Estimate: 1000})
+	st := tr.Status()
+	if st.Queue != 1 || st.Reserved != 1000 || len(st.Disks) != 1 || st.Disks[0].Free <= 0 {
+		t.Errorf("Status = %+v", st)
+	}
+}
@@ -2,9 +2,15 @@ package transcode
 
 import (
 	"bytes"
+	"container/heap"
+	"context"
+	"errors"
+	"io"
 	"log"
+	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Bnei-Baruch/filer-backend/fileutils"
@@ -12,97 +18,398 @@ import (
 
 type (
 	TranscodeTask struct {
-		Ctx    interface{}
-		Preset string
-		Source string
-		Target string
+		ID       string // job ID
+		Ctx      interface{}
+		Duration float64 // duration of the source, seconds
+		Estimate int64   // estimated size of the output, bytes
+		Preset   string
+		Priority int // tasks with higher priority start first
+		Source   string
+		Target   string
 	}
 
 	TranscodeResult struct {
-		Task TranscodeTask
-		Err  error
-		Out  []byte
+		Task    TranscodeTask
+		Err     error
+		Out     []byte
+		Elapsed time.Duration // running time of the task
 	}
 
 	Transcoder interface {
+		Admit(need int64) bool
+		Status() Status
 		Transcode(task TranscodeTask) bool
-		Result() TranscodeResult
+		Cancel(id string) bool
+		Progress(id string) (Progress, bool)
+		Reprioritize(id string, priority int) bool
+		Result() (TranscodeResult, bool)
 		QueueLen() int
+		Stop(ctx context.Context) int
+		Resize(workers int)
 	}
 
 	MultiTranscoder struct {
-		qt chan TranscodeTask
-		qr chan TranscodeResult
+		sync.Mutex
+		cond     *sync.Cond
+		queue    taskQueue
+		seq      uint64
+		running  map[string]context.CancelCauseFunc
+		progress map[string]Progress
+		qr       chan TranscodeResult
+		jobs     *JobStore
+		space    *Space
+		workers  int // target number of workers
+		live     int // started workers
+		nrunning int
+		reserved int64 // estimated output of running tasks
+		stop     chan struct{}
+		wg       sync.WaitGroup // running workers
+		pending  sync.WaitGroup // results of canceled queued tasks
 	}
 )
 
+const (
+	maxQueue     = 100
+	holdInterval = 30 * time.Second
+)
+
 var (
-	optargs string = "-hide_banner -nostats -loglevel error -threads 1"
+	ErrCanceled = errors.New("Transcoding has been canceled")
+	ErrStopped  = errors.New("Transcoder has been stopped")
+
+	optargs string = "-hide_banner -nostats -loglevel error -threads 1 -progress pipe:1"
 )
 
-func transcodeFile(preset, srcpath, dstpath string) (error, []byte) {
+func transcodeFile(ctx context.Context, t TranscodeTask, progress func(p Progress)) (error, []byte) {
 	params := strings.Fields(optargs)
-	params = append(params, "-i", srcpath)
-	params = append(params, strings.Fields(preset)...)
-	params = append(params, dstpath)
+	params = append(params, "-i", t.Source)
+	params = append(params, strings.Fields(t.Preset)...)
+	params = append(params, t.Target)
 
-	cmd := exec.Command("ffmpeg", params...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", params...)
 
 	var out bytes.Buffer
 	cmd.Stderr = &out
 
-	err := cmd.Start()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err, nil
+	}
+	err = cmd.Start()
 	if err != nil {
 		return err, nil
 	}
+	parseProgress(stdout, t.Duration, progress)
+	// the parser may stop early, ffmpeg must not block on a full pipe
+	io.Copy(io.Discard, stdout)
 	err = cmd.Wait()
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
 	return err, out.Bytes()
 }
 
-func transcodeLog(start, finish time.Time, r *TranscodeResult) {
+func transcodeLog(start, finish time.Time, r *TranscodeResult, p Progress) {
 	if r.Err == nil {
-		log.Println("Transcode:", finish.Sub(start)/time.Millisecond*time.Millisecond, fileutils.FileSize(r.Task.Source), r.Task.Source)
+		log.Println("Transcode:", finish.Sub(start)/time.Millisecond*time.Millisecond, fileutils.FileSize(r.Task.Source), r.Task.Source, p)
+	} else if p.Percent > 0 {
+		log.Println("Transcode (stopped):", r.Task.Source, p)
 	}
 }
 
-func transcodeRun(qt <-chan TranscodeTask, qr chan<- TranscodeResult) {
-	go func() {
-		for t := range qt {
-			start := time.Now()
-			r := TranscodeResult{Task: t}
-			r.Err, r.Out = transcodeFile(t.Preset, t.Source, t.Target)
-			transcodeLog(start, time.Now(), &r)
-			qr <- r
+// Keep the progress of the running task and log every 10%
+func (tr *MultiTranscoder) setProgress(t *TranscodeTask, p Progress) {
+	tr.Lock()
+	last := tr.progress[t.ID]
+	tr.progress[t.ID] = p
+	tr.Unlock()
+
+	if int(p.Percent)/10 > int(last.Percent)/10 && p.Percent < 100 {
+		log.Println("Transcode progress:", t.Source, p)
+	}
+}
+
+// Take the next task from the queue.
+// The task is held while there is no disk space for its output.
+// It returns false when the transcoder is stopped or the worker is not needed.
+func (tr *MultiTranscoder) next() (TranscodeTask, context.Context, context.CancelCauseFunc, bool) {
+	tr.Lock()
+	defer tr.Unlock()
+
+	held := ""
+	for {
+		for len(tr.queue) == 0 && !tr.stopped() && tr.live <= tr.workers {
+			tr.cond.Wait()
 		}
-	}()
+		if tr.stopped() || tr.live > tr.workers {
+			tr.live--
+			return TranscodeTask{}, nil, nil, false
+		}
+		t := tr.queue[0].task
+		if tr.space.Admit(t.Estimate + tr.reserved) {
+			break
+		}
+		if held != t.ID {
+			held = t.ID
+			log.Println("Transcode (held, no disk space):", t.Source, fileutils.FileSize(t.Source))
+		}
+		tr.Unlock()
+		select {
+		case <-tr.stop:
+		case <-time.After(holdInterval):
+		}
+		tr.Lock()
+	}
+	item := heap.Pop(&tr.queue).(*queueItem)
+	tr.nrunning++
+	tr.reserved += item.task.Estimate
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	if item.task.ID != "" {
+		tr.running[item.task.ID] = cancel
+	}
+	return item.task, ctx, cancel, true
 }
 
-func NewMultiTranscoder(concurrency int) *MultiTranscoder {
-	mt := &MultiTranscoder{
-		qt: make(chan TranscodeTask, 100),
-		qr: make(chan TranscodeResult, 100),
+func (tr *MultiTranscoder) stopped() bool {
+	select {
+	case <-tr.stop:
+		return true
+	default:
+		return false
 	}
+}
+
+func (tr *MultiTranscoder) run() {
+	defer tr.wg.Done()
+
+	for {
+		t, ctx, cancel, ok := tr.next()
+		if !ok {
+			return
+		}
+
+		start := time.Now()
+		if tr.jobs != nil && t.ID != "" {
+			err := tr.jobs.Update(t.ID, func(job *Job) {
+				job.State = JobRunning
+				job.Started = &start
+			})
+			if err != nil {
+				log.Println("Transcode job:", t.ID, err)
+			}
+		}
+
+		r := TranscodeResult{Task: t}
+		r.Err, r.Out = transcodeFile(ctx, t, func(p Progress) {
+			tr.setProgress(&t, p)
+		})
+
+		r.Elapsed = time.Since(start)
+		cancel(nil)
+		tr.Lock()
+		p := tr.progress[t.ID]
+		delete(tr.running, t.ID)
+		delete(tr.progress, t.ID)
+		tr.nrunning--
+		tr.reserved -= t.Estimate
+		tr.Unlock()
+
+		if r.Err == ErrStopped {
+			tr.checkpoint(&t, p)
+			continue
+		}
+
+		transcodeLog(start, time.Now(), &r, p)
 
-	for i := 0; i < concurrency; i++ {
-		transcodeRun(mt.qt, mt.qr)
+		tr.qr <- r
 	}
+}
+
+// The task interrupted by Stop is queued again in jobs
+// to be resumed after a restart
+func (tr *MultiTranscoder) checkpoint(t *TranscodeTask, p Progress) {
+	os.Remove(t.Target)
+	log.Println("Transcode (stopped, requeued):", t.Source, p)
+
+	if tr.jobs == nil || t.ID == "" {
+		return
+	}
+	err := tr.jobs.Update(t.ID, func(job *Job) {
+		job.State = JobQueued
+		job.Started = nil
+	})
+	if err != nil {
+		log.Println("Transcode job:", t.ID, err)
+	}
+}
+
+// The state of tasks with ID is kept in jobs (optional).
+// Tasks are admitted by the disk space (optional).
+func NewMultiTranscoder(concurrency int, jobs *JobStore, space *Space) *MultiTranscoder {
+	mt := &MultiTranscoder{
+		queue:    make(taskQueue, 0, maxQueue),
+		running:  make(map[string]context.CancelCauseFunc),
+		progress: make(map[string]Progress),
+		qr:       make(chan TranscodeResult, 100),
+		jobs:     jobs,
+		space:    space,
+		stop:     make(chan struct{}),
+	}
+	mt.cond = sync.NewCond(&mt.Mutex)
+	mt.Resize(concurrency)
 
 	return mt
 }
 
-func (tr *MultiTranscoder) QueueLen() int {
-	return len(tr.qt)
+// Resize the worker pool. Extra workers exit after their running tasks.
+func (tr *MultiTranscoder) Resize(workers int) {
+	tr.Lock()
+	defer tr.Unlock()
+
+	if tr.stopped() || workers < 0 {
+		return
+	}
+	tr.workers = workers
+	for ; tr.live < workers; tr.live++ {
+		tr.wg.Add(1)
+		go tr.run()
+	}
+	tr.cond.Broadcast()
 }
 
-func (tr *MultiTranscoder) Result() TranscodeResult {
-	return <-tr.qr
+// Admit reports whether there is disk space for need bytes
+// in addition to the output of queued and running tasks
+func (tr *MultiTranscoder) Admit(need int64) bool {
+	tr.Lock()
+	defer tr.Unlock()
+
+	return tr.space.Admit(need + tr.queued() + tr.reserved)
 }
 
-func (tr *MultiTranscoder) Transcode(task TranscodeTask) bool {
-	select {
-	case tr.qt <- task:
+// Estimated output of queued tasks
+func (tr *MultiTranscoder) queued() int64 {
+	var n int64
+	for _, item := range tr.queue {
+		n += item.task.Estimate
+	}
+	return n
+}
+
+// Cancel a queued or running task. The task is reported as a result with ErrCanceled.
+func (tr *MultiTranscoder) Cancel(id string) bool {
+	tr.Lock()
+	defer tr.Unlock()
+
+	if tr.stopped() {
+		return false
+	}
+	if cancel, ok := tr.running[id]; ok {
+		cancel(ErrCanceled)
+		return true
+	}
+	if t, ok := tr.queue.remove(id); ok {
+		tr.pending.Add(1)
+		go func() {
+			defer tr.pending.Done()
+			tr.qr <- TranscodeResult{Task: t, Err: ErrCanceled}
+		}()
 		return true
-	default:
 	}
 	return false
 }
+
+// Progress of a running task
+func (tr *MultiTranscoder) Progress(id string) (Progress, bool) {
+	tr.Lock()
+	defer tr.Unlock()
+
+	p, ok := tr.progress[id]
+	return p, ok
+}
+
+func (tr *MultiTranscoder) QueueLen() int {
+	tr.Lock()
+	defer tr.Unlock()
+
+	return len(tr.queue)
+}
+
+// Change the priority of a queued task
+func (tr *MultiTranscoder) Reprioritize(id string, priority int) bool {
+	tr.Lock()
+	defer tr.Unlock()
+
+	return tr.queue.reprioritize(id, priority)
+}
+
+func (tr *MultiTranscoder) Status() Status {
+	tr.Lock()
+	defer tr.Unlock()
+
+	return Status{
+		Queue:    len(tr.queue),
+		Running:  tr.nrunning,
+		Workers:  tr.workers,
+		Reserved: tr.queued() + tr.reserved,
+		Disks:    tr.space.Status(),
+	}
+}
+
+// Result waits for the next result.
+// It returns false after Stop when all results are taken.
+func (tr *MultiTranscoder) Result() (TranscodeResult, bool) {
+	r, ok := <-tr.qr
+	return r, ok
+}
+
+// Stop takes no more tasks from the queue and waits for the running tasks
+// until ctx is done. Then the running tasks are stopped and requeued in jobs.
+// Queued tasks remain queued in jobs. It returns the number of stopped tasks.
+func (tr *MultiTranscoder) Stop(ctx context.Context) int {
+	tr.Lock()
+	if tr.stopped() {
+		tr.Unlock()
+		return 0
+	}
+	close(tr.stop)
+	tr.cond.Broadcast()
+	tr.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		tr.wg.Wait()
+		close(done)
+	}()
+
+	n := 0
+	select {
+	case <-done:
+	case <-ctx.Done():
+		tr.Lock()
+		for _, cancel := range tr.running {
+			cancel(ErrStopped)
+			n++
+		}
+		tr.Unlock()
+		<-done
+	}
+
+	// canceled queued tasks may still be sending their results
+	tr.pending.Wait()
+	close(tr.qr)
+	return n
+}
+
+func (tr *MultiTranscoder) Transcode(task TranscodeTask) bool {
+	tr.Lock()
+	defer tr.Unlock()
+
+	if len(tr.queue) >= maxQueue || tr.stopped() {
+		return false
+	}
+	tr.seq++
+	heap.Push(&tr.queue, &queueItem{task: task, seq: tr.seq})
+	tr.cond.Signal()
+	return true
+}
@@ -0,0 +1,35 @@
+package transcode
+
+import (
+	"fmt"
+	"math"
+)
+
+// VerifyOutput checks the probed output of a transcoding. The duration must
+// match the duration of the source within tolerance (seconds) and the output
+// must have one audio stream and one video stream unless it is audio only.
+// The zero duration of the source is not checked.
+func VerifyOutput(probe *FFprobe, duration, tolerance float64, audioOnly bool) error {
+	var naudio, nvideo int
+	for _, st := range probe.Streams {
+		switch st.Type {
+		case "audio":
+			naudio++
+		case "video":
+			nvideo++
+		}
+	}
+
+	evideo := 1
+	if audioOnly {
+		evideo = 0
+	}
+	if naudio != 1 || nvideo != evideo {
+		return fmt.Errorf("Wrong streams of the output: %d audio, %d video, expected 1 audio, %d video", naudio, nvideo, evideo)
+	}
+
+	if duration > 0 && math.Abs(probe.Format.Duration-duration) > tolerance {
+		return fmt.Errorf("Wrong duration of the output: %.3fs, the source is %.3fs", probe.Format.Duration, duration)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package transcode
+
+import (
+	"testing"
+)
+
+func TestVerifyOutput(t *testing.T) {
+	av := &FFprobe{
+		Format:  FFformat{Duration: 3599.5},
+		Streams: []*FFstream{{Type: "video"}, {Type: "audio"}},
+	}
+	a := &FFprobe{
+		Format:  FFformat{Duration: 3600.2},
+		Streams: []*FFstream{{Type: "audio"}},
+	}
+
+	tests := []struct {
+		probe     *FFprobe
+		duration  float64
+		audioOnly bool
+		ok        bool
+	}{
+		{av, 3600, false, true},
+		{av, 3610, false, false},
+		{av, 0, false, true},
+		{av, 3600, true, false},
+		{a, 3600, true, true},
+		{a, 3600, false, false},
+		{a, 1800, true, false},
+	}
+	for i, x := range tests {
+		err := VerifyOutput(x.probe, x.duration, 1, x.audioOnly)
+		if (err == nil) != x.ok {
+			t.Errorf("VerifyOutput %d = %v, expected ok %v", i, err, x.ok)
+		}
+	}
+}
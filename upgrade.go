@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The new process inherits the listening socket, a pipe to report readiness
+// and a pipe which is closed when the old process has released the jobs
+const (
+	envListenFD  = "FILER_LISTEN_FD"
+	envReadyFD   = "FILER_READY_FD"
+	envReleaseFD = "FILER_RELEASE_FD"
+)
+
+var (
+	errNotReady = errors.New("The new process exited before it was ready")
+
+	// set while the transcoding jobs are handed over to the new process
+	handoff int32
+)
+
+func inHandoff() bool {
+	return atomic.LoadInt32(&handoff) != 0
+}
+
+func setHandoff(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&handoff, v)
+}
+
+// Wait until the old process has released the transcoding jobs.
+// It returns false at once if the process is not upgraded.
+func waitRelease() bool {
+	s := os.Getenv(envReleaseFD)
+	if s == "" {
+		return false
+	}
+	os.Unsetenv(envReleaseFD)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		log.Println("Upgrade:", err)
+		return false
+	}
+	// EOF when the old process closes the pipe or exits
+	f := os.NewFile(uintptr(fd), "release")
+	io.Copy(io.Discard, f)
+	f.Close()
+	log.Println("Upgrade: the jobs are released")
+	return true
+}
+
+// The process has been started by upgrade and waits for the jobs
+func upgraded() bool {
+	return os.Getenv(envReleaseFD) != ""
+}
+
+// Listen on addr or take the socket inherited from the old process
+func listen(addr string) (net.Listener, error) {
+	s := os.Getenv(envListenFD)
+	if s == "" {
+		return net.Listen("tcp", addr)
+	}
+	os.Unsetenv(envListenFD)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// Report to the old process that the new one is ready to serve
+func reportReady(records int) {
+	s := os.Getenv(envReadyFD)
+	if s == "" {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		log.Println("Upgrade:", err)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	fmt.Fprintf(f, "ready %d\n", records)
+	f.Close()
+}
+
+// Start the executable with the listening socket and wait until it is ready.
+// The new process is killed if it does not become ready within timeout.
+// The new process resumes the transcoding jobs when release is closed.
+func upgrade(l net.Listener, timeout time.Duration) (release *os.File, err error) {
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil, errors.New("Listener is not TCP")
+	}
+	lf, err := tl.File()
+	if err != nil {
+		return nil, err
+	}
+	defer lf.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	rr, rw, err := os.Pipe()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	prog, err := os.Executable()
+	if err != nil {
+		w.Close()
+		rr.Close()
+		rw.Close()
+		return nil, err
+	}
+	cmd := exec.Command(prog, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{lf, w, rr} // fd 3, 4 and 5
+	cmd.Env = append(os.Environ(), envListenFD+"=3", envReadyFD+"=4", envReleaseFD+"=5")
+	err = cmd.Start()
+	w.Close()
+	rr.Close()
+	if err != nil {
+		rw.Close()
+		return nil, err
+	}
+	log.Println("Upgrade: started", prog, "pid", cmd.Process.Pid)
+
+	// EOF without the report if the new process exits
+	ready := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(r).ReadString('\n')
+		if err != nil {
+			ready <- errNotReady
+			return
+		}
+		log.Print("Upgrade: pid ", cmd.Process.Pid, " ", line)
+		ready <- nil
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = errors.New("The new process is not ready in " + timeout.String())
+	}
+	if err != nil {
+		rw.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	cmd.Process.Release()
+	return rw, nil
+}